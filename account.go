@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type EmailRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type TokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type PasswordResetRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func actionLink(path, token string) string {
+	return fmt.Sprintf("%s%s?token=%s", appBaseURL, path, url.QueryEscape(token))
+}
+
+func sendVerificationEmail(ctx context.Context, user User) error {
+	token, err := issueActionToken(ctx, user.ID, PurposeVerifyEmail, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nconfirm your email address by opening the link below:\n\n%s\n\nThe link expires in %s.\n",
+			user.Name, actionLink("/verify-email", token), emailVerificationTTL),
+	})
+}
+
+func sendPasswordResetEmail(ctx context.Context, user User) error {
+	token, err := issueActionToken(ctx, user.ID, PurposeResetPassword, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+	return mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nyou can choose a new password by opening the link below:\n\n%s\n\nThe link expires in %s. If you did not ask for this, ignore this message.\n",
+			user.Name, actionLink("/reset-password", token), passwordResetTTL),
+	})
+}
+
+// RequestEmailVerification resends the verification mail. It answers the
+// same way whether or not the address is known.
+func RequestEmailVerification(c *gin.Context) {
+	req := EmailRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	var user User
+	filter := bson.M{"email": normalizeEmail(req.Email), "deleted_at": notDeleted}
+	if err := db.Collection("users").FindOne(context.TODO(), filter).Decode(&user); err == nil && !user.EmailVerified {
+		if err := sendVerificationEmail(context.TODO(), user); err != nil {
+			log.Println("sending verification email failed:", err)
+		}
+	}
+	c.IndentedJSON(http.StatusAccepted, gin.H{"Message": "If the address belongs to an unverified account, a verification email is on its way"})
+}
+
+func ConfirmEmailVerification(c *gin.Context) {
+	req := TokenRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	record, err := consumeActionToken(context.TODO(), req.Token, PurposeVerifyEmail)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Invalid or expired token"})
+		return
+	}
+	update := bson.M{"$set": bson.M{"email_verified": true}}
+	if _, err := db.Collection("users").UpdateByID(context.TODO(), record.UserID, update); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Email address verified"})
+}
+
+// RequestPasswordReset mails a reset link. It answers the same way whether
+// or not the address is known.
+func RequestPasswordReset(c *gin.Context) {
+	req := EmailRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	var user User
+	filter := bson.M{"email": normalizeEmail(req.Email), "deleted_at": notDeleted}
+	if err := db.Collection("users").FindOne(context.TODO(), filter).Decode(&user); err == nil {
+		if err := sendPasswordResetEmail(context.TODO(), user); err != nil {
+			log.Println("sending password reset email failed:", err)
+		}
+	}
+	c.IndentedJSON(http.StatusAccepted, gin.H{"Message": "If the address belongs to an account, a password reset email is on its way"})
+}
+
+// ConfirmPasswordReset sets a new password and ends every existing session
+// of the account.
+func ConfirmPasswordReset(c *gin.Context) {
+	req := PasswordResetRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	record, err := consumeActionToken(context.TODO(), req.Token, PurposeResetPassword)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Invalid or expired token"})
+		return
+	}
+	hashedPassword, err := passwordHasher.Hash(req.Password)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	// receiving the reset mail proves ownership of the address as well
+	update := bson.M{"$set": bson.M{"password": hashedPassword, "email_verified": true}}
+	filter := bson.M{"_id": record.UserID, "deleted_at": notDeleted}
+	result, err := db.Collection("users").UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		// the account went to the trash after the token was sent
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Invalid or expired token"})
+		return
+	}
+	if err := revokeUserSessions(context.TODO(), record.UserID); err != nil {
+		log.Println("revoking sessions after password reset failed:", err)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Password updated"})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type APIKeyRequest struct {
+	Name      string       `json:"name" binding:"required"`
+	Scopes    []Permission `json:"scopes" binding:"required,min=1"`
+	ExpiresAt *time.Time   `json:"expires_at"`
+}
+
+// personal access token handlers
+
+func CreatePersonalAccessToken(c *gin.Context) {
+	principal := currentPrincipal(c)
+	if principal.Method == AuthAPIKey {
+		// a leaked key must not be able to mint more keys
+		c.IndentedJSON(http.StatusForbidden, gin.H{"Error": "Access tokens cannot be created with an access token"})
+		return
+	}
+
+	req := APIKeyRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validPermission(scope) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Unknown scope %q", scope)})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "expires_at must be in the future"})
+		return
+	}
+
+	secret, err := generateToken(32)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	raw := apiKeyPrefix + secret
+	key := APIKey{
+		UserID:    principal.UserID,
+		Name:      req.Name,
+		KeyHash:   hashToken(raw),
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: req.ExpiresAt,
+	}
+	resp, err := db.Collection("apikeys").InsertOne(context.TODO(), key)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	key.ID = resp.InsertedID.(primitive.ObjectID)
+	// the raw token is only ever shown here
+	c.IndentedJSON(http.StatusCreated, gin.H{"Token": raw, "AccessToken": key})
+}
+
+func ListPersonalAccessTokens(c *gin.Context) {
+	principal := currentPrincipal(c)
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	cursor, err := db.Collection("apikeys").Find(context.TODO(), bson.M{"user_id": principal.UserID}, opts)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	keys := []APIKey{}
+	if err = cursor.All(context.TODO(), &keys); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, keys)
+}
+
+// revokeAPIKeys revokes every personal access token of userID that is not
+// revoked yet and returns how many it revoked.
+func revokeAPIKeys(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	filter := bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}}
+	result, err := db.Collection("apikeys").UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func RevokePersonalAccessToken(c *gin.Context) {
+	principal := currentPrincipal(c)
+	keyId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	filter := bson.M{"_id": keyId, "user_id": principal.UserID}
+	update := bson.M{"$set": bson.M{"revoked_at": time.Now()}}
+	result, err := db.Collection("apikeys").UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Access token not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Access token revoked"})
+}
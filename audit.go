@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The audit log records security relevant events in the auditevents
+// collection, which the application only ever appends to. Every event
+// carries a sequence number and the hash of its predecessor, so deleting,
+// reordering or editing events breaks the chain and verifyAuditChain
+// reports where.
+
+type AuditAction string
+
+const (
+	AuditLogin            AuditAction = "login"
+	AuditLoginFailed      AuditAction = "login_failed"
+	AuditRegister         AuditAction = "register"
+	AuditUserDeleted      AuditAction = "user_deleted"
+	AuditUserRestored     AuditAction = "user_restored"
+	AuditUserPurged       AuditAction = "user_purged"
+	AuditBlogDeleted      AuditAction = "blog_deleted"
+	AuditCommentDeleted   AuditAction = "comment_deleted"
+	AuditRolesChanged     AuditAction = "roles_changed"
+	AuditDataExported     AuditAction = "data_exported"
+	AuditPermissionDenied AuditAction = "permission_denied"
+)
+
+var ErrAuditChainBroken = errors.New("audit chain broken")
+
+// auditAppendAttempts bounds the retries when concurrent events race for
+// the same sequence number.
+const auditAppendAttempts = 10
+
+type AuditEvent struct {
+	ID   primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Seq  int64              `bson:"seq" json:"seq"`
+	Time time.Time          `bson:"time" json:"time"`
+	// ActorID is who acted; it is unset for failed logins of unknown
+	// users, where ActorName is the name that was tried.
+	ActorID   primitive.ObjectID `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	ActorName string             `bson:"actor_name,omitempty" json:"actor_name,omitempty"`
+	Action    AuditAction        `bson:"action" json:"action"`
+	TargetID  primitive.ObjectID `bson:"target_id,omitempty" json:"target_id,omitempty"`
+	IP        string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	Details   map[string]string  `bson:"details,omitempty" json:"details,omitempty"`
+	PrevHash  string             `bson:"prev_hash" json:"prev_hash"`
+	Hash      string             `bson:"hash" json:"hash"`
+}
+
+// auditHash returns the hash chaining event to its predecessor. It covers
+// every field but ID and Hash; JSON encodes them in a fixed order.
+func auditHash(event AuditEvent) string {
+	content, _ := json.Marshal(struct {
+		Seq       int64
+		Time      int64
+		ActorID   string
+		ActorName string
+		Action    AuditAction
+		TargetID  string
+		IP        string
+		Details   map[string]string
+		PrevHash  string
+	}{
+		event.Seq, event.Time.UnixMilli(), event.ActorID.Hex(), event.ActorName, event.Action,
+		event.TargetID.Hex(), event.IP, event.Details, event.PrevHash,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// appendAuditEvent links event to the end of the chain and stores it.
+func appendAuditEvent(ctx context.Context, event AuditEvent) (AuditEvent, error) {
+	// Mongo keeps milliseconds; hash what will be read back
+	event.Time = event.Time.UTC().Truncate(time.Millisecond)
+	if len(event.Details) == 0 {
+		// an empty map is not stored and would hash differently when read
+		event.Details = nil
+	}
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		var last AuditEvent
+		opts := options.FindOne().SetSort(bson.M{"seq": -1})
+		err := db.Collection("auditevents").FindOne(ctx, bson.M{}, opts).Decode(&last)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return event, err
+		}
+		event.ID = primitive.NewObjectID()
+		event.Seq = last.Seq + 1
+		event.PrevHash = last.Hash
+		event.Hash = auditHash(event)
+		_, err = db.Collection("auditevents").InsertOne(ctx, event)
+		if err == nil {
+			return event, nil
+		}
+		// another event took the sequence number, link to that one instead
+		if !mongo.IsDuplicateKeyError(err) {
+			return event, err
+		}
+	}
+	return event, fmt.Errorf("appending audit event: gave up after %d attempts", auditAppendAttempts)
+}
+
+// recordAudit appends event on behalf of the request. The actor defaults to
+// the authenticated caller. Failures are logged but do not fail the request.
+func recordAudit(c *gin.Context, event AuditEvent) {
+	principal := currentPrincipal(c)
+	if event.ActorID.IsZero() && event.ActorName == "" {
+		event.ActorID = principal.UserID
+		event.ActorName = principal.Name
+	}
+	event.Time = time.Now()
+	event.IP = c.ClientIP()
+	if _, err := appendAuditEvent(context.TODO(), event); err != nil {
+		log.Printf("recording audit event %s failed: %v", event.Action, err)
+	}
+}
+
+// verifyAuditChain walks the whole log and returns the number of events,
+// or ErrAuditChainBroken at the first one that does not link up.
+func verifyAuditChain(ctx context.Context) (int64, error) {
+	opts := options.Find().SetSort(bson.M{"seq": 1})
+	cursor, err := db.Collection("auditevents").Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	var count int64
+	prevHash := ""
+	for cursor.Next(ctx) {
+		var event AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			return count, err
+		}
+		count++
+		if event.Seq != count || event.PrevHash != prevHash || event.Hash != auditHash(event) {
+			return count, fmt.Errorf("%w at event %d", ErrAuditChainBroken, count)
+		}
+		prevHash = event.Hash
+	}
+	return count, cursor.Err()
+}
+
+// audit handlers
+
+// ListAuditEvents returns audit events newest first, optionally filtered by
+// actor (an ID or a name), action and a from/to time range in RFC 3339.
+func ListAuditEvents(c *gin.Context) {
+	after, limit, err := pageParams(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
+	}
+	filter := bson.M{}
+	if actor := c.Query("actor"); actor != "" {
+		if actorID, err := primitive.ObjectIDFromHex(actor); err == nil {
+			filter["actor_id"] = actorID
+		} else {
+			filter["actor_name"] = actor
+		}
+	}
+	if action := c.Query("action"); action != "" {
+		filter["action"] = action
+	}
+	timeRange := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("%s must be an RFC 3339 time", param)})
+			return
+		}
+		timeRange[op] = t
+	}
+	if len(timeRange) > 0 {
+		filter["time"] = timeRange
+	}
+	if after != nil {
+		filter = bson.M{"$and": bson.A{filter, after.after("time", "_id")}}
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit + 1))
+	cursor, err := db.Collection("auditevents").Find(context.TODO(), filter, opts)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	events := []AuditEvent{}
+	if err = cursor.All(context.TODO(), &events); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	next := ""
+	if len(events) > limit {
+		events = events[:limit]
+		last := events[limit-1]
+		next = pageCursor{Time: last.Time, ID: last.ID}.String()
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"events": events, "next_cursor": next})
+}
+
+// VerifyAuditLog checks the hash chain of the whole audit log.
+func VerifyAuditLog(c *gin.Context) {
+	count, err := verifyAuditChain(context.TODO())
+	if errors.Is(err, ErrAuditChainBroken) {
+		c.IndentedJSON(http.StatusOK, gin.H{"valid": false, "events": count, "Error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"valid": true, "events": count})
+}
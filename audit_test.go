@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+func TestAuditHashCoversEventFields(t *testing.T) {
+	event := AuditEvent{
+		Seq:       7,
+		Time:      time.UnixMilli(1700000000000).UTC(),
+		ActorID:   primitive.NewObjectID(),
+		ActorName: "someone",
+		Action:    AuditLogin,
+		IP:        "10.0.0.1",
+		Details:   map[string]string{"method": "password"},
+		PrevHash:  "abc",
+	}
+	hash := auditHash(event)
+	assert.Equal(t, hash, auditHash(event))
+
+	for name, change := range map[string]func(e *AuditEvent){
+		"seq":       func(e *AuditEvent) { e.Seq++ },
+		"time":      func(e *AuditEvent) { e.Time = e.Time.Add(time.Millisecond) },
+		"actor":     func(e *AuditEvent) { e.ActorName = "someone else" },
+		"action":    func(e *AuditEvent) { e.Action = AuditLoginFailed },
+		"target":    func(e *AuditEvent) { e.TargetID = primitive.NewObjectID() },
+		"details":   func(e *AuditEvent) { e.Details = map[string]string{"method": "oidc"} },
+		"prev hash": func(e *AuditEvent) { e.PrevHash = "abd" },
+	} {
+		changed := event
+		change(&changed)
+		assert.Assert(t, auditHash(changed) != hash, name)
+	}
+}
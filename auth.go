@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrNoCredentials  = errors.New("no credentials")
+	ErrAPIKeyUnusable = errors.New("api key revoked or expired")
+)
+
+// AuthMethod records how the caller authenticated.
+type AuthMethod string
+
+const (
+	AuthCookie AuthMethod = "cookie"
+	AuthBearer AuthMethod = "bearer"
+	AuthAPIKey AuthMethod = "api_key"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID    primitive.ObjectID
+	Name      string
+	Roles     []Role
+	SessionID string
+	Method    AuthMethod
+	// Scopes restricts an API key to a subset of the user's permissions.
+	// It is nil for sessions and unrestricted keys.
+	Scopes []Permission
+}
+
+const principalKey = "principal"
+
+// apiKeyPrefix marks API keys so they are recognisable in logs and secret
+// scanners.
+const apiKeyPrefix = "blog_"
+
+func principalFromClaims(claims *TokenClaims, method AuthMethod) Principal {
+	return Principal{
+		UserID:    claims.UserID(),
+		Name:      claims.Username,
+		Roles:     claims.Roles,
+		SessionID: claims.SessionID,
+		Method:    method,
+	}
+}
+
+// authenticateUser resolves the caller from an Authorization: Bearer access
+// token, an X-API-Key header or the token cookie, in that order.
+func authenticateUser(c *gin.Context) (Principal, error) {
+	if header := c.GetHeader("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return Principal{}, errors.New("unsupported authorization scheme")
+		}
+		token = strings.TrimSpace(token)
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			return authenticateAPIKey(context.TODO(), token)
+		}
+		claims, err := VerifyToken(token)
+		if err != nil {
+			return Principal{}, err
+		}
+		return principalFromClaims(claims, AuthBearer), nil
+	}
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return authenticateAPIKey(context.TODO(), key)
+	}
+	token, err := c.Cookie("token")
+	if err != nil {
+		return Principal{}, ErrNoCredentials
+	}
+	claims, err := VerifyToken(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	return principalFromClaims(claims, AuthCookie), nil
+}
+
+// authenticateAPIKey resolves an API key to the user it was issued to. The
+// principal carries the user's current roles and the key's scopes.
+func authenticateAPIKey(ctx context.Context, raw string) (Principal, error) {
+	var key APIKey
+	if err := db.Collection("apikeys").FindOne(ctx, bson.M{"key_hash": hashToken(raw)}).Decode(&key); err != nil {
+		return Principal{}, err
+	}
+	now := time.Now()
+	if !key.Usable(now) {
+		return Principal{}, ErrAPIKeyUnusable
+	}
+	if _, err := db.Collection("apikeys").UpdateByID(ctx, key.ID, bson.M{"$set": bson.M{"last_used_at": now}}); err != nil {
+		return Principal{}, err
+	}
+	var user User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": key.UserID, "deleted_at": notDeleted}).Decode(&user); err != nil {
+		return Principal{}, err
+	}
+	return Principal{
+		UserID: user.ID,
+		Name:   user.Name,
+		Roles:  user.EffectiveRoles(),
+		Method: AuthAPIKey,
+		Scopes: key.Scopes,
+	}, nil
+}
+
+// Authenticate rejects requests without valid credentials and stores the
+// caller's Principal in the context for the handlers that follow.
+func Authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := authenticateUser(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+			return
+		}
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+// currentPrincipal returns the caller stored by Authenticate, or the zero
+// Principal on routes that do not require authentication.
+func currentPrincipal(c *gin.Context) Principal {
+	principal, _ := c.Get(principalKey)
+	p, _ := principal.(Principal)
+	return p
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Blogs are addressed by ID or by a slug made from their title. Slugs are
+// unique; a title that is already taken gets a numeric suffix.
+
+const (
+	maxSlugLength    = 80
+	maxSummaryLength = 200
+	// slugAttempts bounds the numbered variants tried before falling back
+	// to the blog ID as suffix.
+	slugAttempts = 20
+)
+
+// slugify turns title into lowercase ASCII words joined by hyphens.
+func slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+			continue
+		}
+		hyphen = true
+	}
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	return slug
+}
+
+// summarize returns the start of content as a one-line summary.
+func summarize(content string) string {
+	summary := strings.Join(strings.Fields(content), " ")
+	if utf8.RuneCountInString(summary) <= maxSummaryLength {
+		return summary
+	}
+	runes := []rune(summary)[:maxSummaryLength]
+	if i := strings.LastIndex(string(runes), " "); i > 0 {
+		return string(runes)[:i] + "…"
+	}
+	return string(runes) + "…"
+}
+
+// insertBlog stores blog under the first free slug derived from its title.
+// Untitled blogs use their ID as slug.
+func insertBlog(ctx context.Context, blog Blog) (Blog, error) {
+	if blog.ID.IsZero() {
+		blog.ID = primitive.NewObjectID()
+	}
+	base := slugify(blog.Title)
+	if base == "" {
+		blog.Slug = blog.ID.Hex()
+		_, err := db.Collection("blogs").InsertOne(ctx, blog)
+		return blog, err
+	}
+	for attempt := 1; ; attempt++ {
+		switch {
+		case attempt == 1:
+			blog.Slug = base
+		case attempt <= slugAttempts:
+			blog.Slug = fmt.Sprintf("%s-%d", base, attempt)
+		default:
+			blog.Slug = base + "-" + blog.ID.Hex()
+		}
+		_, err := db.Collection("blogs").InsertOne(ctx, blog)
+		if err == nil || !mongo.IsDuplicateKeyError(err) || attempt > slugAttempts {
+			return blog, err
+		}
+	}
+}
+
+// blogAuthorID returns who wrote blog, looking at its blog record for blogs
+// stored without an author.
+func blogAuthorID(ctx context.Context, blog Blog) (primitive.ObjectID, error) {
+	if !blog.AuthorID.IsZero() {
+		return blog.AuthorID, nil
+	}
+	var record BlogRecord
+	err := db.Collection("blogrecords").FindOne(ctx, bson.M{"blog_id": blog.ID}).Decode(&record)
+	return record.UserID, err
+}
+
+// respondBlogDetail responds with the blog matching filter and its author.
+// Blogs the caller may not see, and blogs whose author is in the trash, are
+// reported as missing, as listBlogs leaves them out.
+func respondBlogDetail(c *gin.Context, filter bson.M) {
+	filter["deleted_at"] = notDeleted
+	var blog Blog
+	if err := db.Collection("blogs").FindOne(context.TODO(), filter).Decode(&blog); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	visible, err := canSeeBlog(context.TODO(), currentPrincipal(c), blog)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if !visible {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+		return
+	}
+	blog = cacheBlogHTML(context.TODO(), blog)
+	detail := BlogDetail{BlogResponse: newBlogResponse(blog)}
+	authorID, err := blogAuthorID(context.TODO(), blog)
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	detail.AuthorID = authorID
+	var author User
+	err = db.Collection("users").FindOne(context.TODO(), bson.M{"_id": authorID, "deleted_at": notDeleted}).Decode(&author)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	public := newPublicUser(author)
+	detail.Author = &public
+	c.IndentedJSON(http.StatusOK, detail)
+}
+
+// blogSortDate is the date blogs are listed by, with the blog fields under
+// "blog.": the publish date, or for blogs never published, such as drafts,
+// the time they were last edited or else created.
+var blogSortDate = bson.M{"$cond": bson.A{
+	bson.M{"$gt": bson.A{"$blog.pub_date", time.Time{}}},
+	"$blog.pub_date",
+	bson.M{"$ifNull": bson.A{"$blog.updated_at", bson.M{"$toDate": "$blog._id"}}},
+}}
+
+// listBlogs joins the blog records matching recordMatch to their blogs
+// matching blogMatch, which may be nil, and their authors and returns a page
+// of them, newest first, with the cursor of the next page. Blogs in the
+// trash and blogs of authors in the trash are left out.
+func listBlogs(ctx context.Context, recordMatch, blogMatch bson.M, after *pageCursor, limit int) ([]FeedEntry, string, error) {
+	conditions := bson.A{bson.M{"blog.deleted_at": notDeleted}}
+	if blogMatch != nil {
+		conditions = append(conditions, blogMatch)
+	}
+	if after != nil {
+		conditions = append(conditions, after.after("sort_date", "blog._id"))
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: recordMatch}},
+		{{Key: "$lookup", Value: bson.M{"from": "blogs", "localField": "blog_id", "foreignField": "_id", "as": "blog"}}},
+		{{Key: "$unwind", Value: "$blog"}},
+		{{Key: "$addFields", Value: bson.M{"sort_date": blogSortDate}}},
+		{{Key: "$match", Value: bson.M{"$and": conditions}}},
+		{{Key: "$sort", Value: bson.D{{Key: "sort_date", Value: -1}, {Key: "blog._id", Value: -1}}}},
+		{{Key: "$lookup", Value: bson.M{"from": "users", "localField": "user_id", "foreignField": "_id", "as": "author"}}},
+		{{Key: "$unwind", Value: "$author"}},
+		{{Key: "$match", Value: bson.M{"author.deleted_at": notDeleted}}},
+		{{Key: "$limit", Value: limit + 1}},
+	}
+	cursor, err := db.Collection("blogrecords").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, "", err
+	}
+	entries := []feedEntry{}
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		next = pageCursor{Time: last.SortDate, ID: last.Blog.ID}.String()
+	}
+	blogs := make([]FeedEntry, len(entries))
+	for i, entry := range entries {
+		response := newBlogResponse(cacheBlogHTML(ctx, entry.Blog))
+		// blogs stored before authors were recorded only have the record
+		response.AuthorID = entry.Author.ID
+		blogs[i] = FeedEntry{BlogResponse: response, Author: newPublicUser(entry.Author)}
+	}
+	return blogs, next, nil
+}
+
+// blog handlers
+
+func GetBlogByID(c *gin.Context) {
+	blogId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	respondBlogDetail(c, bson.M{"_id": blogId})
+}
+
+func GetBlogBySlug(c *gin.Context) {
+	respondBlogDetail(c, bson.M{"slug": c.Param("slug")})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"gotest.tools/assert"
+)
+
+func TestSlugify(t *testing.T) {
+	for title, slug := range map[string]string{
+		"Hello, World!":            "hello-world",
+		"  Go 1.22 -- what's new ": "go-1-22-what-s-new",
+		"Café au lait":             "caf-au-lait",
+		"日本語":                      "",
+		"":                         "",
+	} {
+		assert.Equal(t, slug, slugify(title), title)
+	}
+	long := slugify(strings.Repeat("word ", 40))
+	assert.Assert(t, len(long) <= maxSlugLength)
+	assert.Assert(t, !strings.HasSuffix(long, "-"))
+}
+
+func TestSummarize(t *testing.T) {
+	assert.Equal(t, "short post over two lines", summarize("short post\n\nover  two lines"))
+	summary := summarize(strings.Repeat("lorem ipsum ", 50))
+	assert.Assert(t, utf8.RuneCountInString(summary) <= maxSummaryLength+1)
+	assert.Assert(t, strings.HasSuffix(summary, "ipsum…") || strings.HasSuffix(summary, "lorem…"))
+}
@@ -2,13 +2,63 @@ package main
 
 import (
 	"context"
+	"log"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var SecretKey = []byte("secret-key")
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using %d", value, key, fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using %t", value, key, fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("invalid value %q for %s, using %s", value, key, fallback)
+		return fallback
+	}
+	return d
+}
 
 func initDb(uri string, database string) (*mongo.Database, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -21,4 +71,244 @@ func initDb(uri string, database string) (*mongo.Database, error) {
 	return db, nil
 }
 
+// ensureIndexes creates the indexes the handlers rely on for uniqueness and
+// expiry. Creating an index that already exists is a no-op.
+func ensureIndexes(db *mongo.Database) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := db.Collection("refreshtokens").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"token_hash": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"family_id": 1}},
+		{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("apikeys").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"key_hash": 1}, Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("actiontokens").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("users").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"name": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.M{"email": 1}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("loginattempts").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("users").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "oidc_issuer", Value: 1}, {Key: "oidc_subject", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"oidc_subject": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("oidcstates").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("sessions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"user_id": 1}},
+		{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("auditevents").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"seq": 1}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "time", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "time", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("blogs").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.M{"slug": 1}, Options: options.Index().SetUnique(true).SetSparse(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("blogs").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "publish_at", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("blogrevisions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "blog_id", Value: 1}, {Key: "number", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("exports").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"expires_at": 1}},
+		// one export is built per user at a time
+		{Keys: bson.M{"user_id": 1}, Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"status": ExportPending})},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Collection("follows").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "follower_id", Value: 1}, {Key: "followee_id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "followee_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+func initPasswordHasher() PasswordHasher {
+	hasher, err := NewPasswordHasher(
+		getEnv("PASSWORD_HASHER", "argon2id"),
+		getEnvInt("ARGON2_MEMORY_KIB", 64*1024),
+		getEnvInt("ARGON2_ITERATIONS", 3),
+		getEnvInt("ARGON2_PARALLELISM", 2),
+		getEnvInt("BCRYPT_COST", 12),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return hasher
+}
+
 var db, _ = initDb("mongodb://localhost:27017", "blogdb")
+
+var passwordHasher = initPasswordHasher()
+
+var cookieConfig = initCookieConfig()
+
+// keyRing signs and verifies access tokens; it is loaded from disk in main.
+var keyRing *KeyRing
+
+func initKeyRing() *KeyRing {
+	kr, err := LoadKeyRing(getEnv("JWT_KEY_DIR", "keys"), getEnv("JWT_KEY_ALG", "RS256"))
+	if err != nil {
+		log.Fatal("failed to load signing keys: ", err)
+	}
+	go kr.WatchForRotation(time.Minute)
+	return kr
+}
+
+var (
+	accessTokenTTL       = getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+	refreshTokenTTL      = getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	emailVerificationTTL = getEnvDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour)
+	passwordResetTTL     = getEnvDuration("PASSWORD_RESET_TTL", time.Hour)
+	mfaChallengeTTL      = getEnvDuration("MFA_CHALLENGE_TTL", 5*time.Minute)
+	appBaseURL           = getEnv("APP_BASE_URL", "http://localhost:8080")
+	totpIssuer           = getEnv("TOTP_ISSUER", "blog-api")
+	oidcStateTTL         = getEnvDuration("OIDC_STATE_TTL", 10*time.Minute)
+)
+
+// Failed login throttling, see LoginThrottlePolicy. Counters are forgotten
+// after loginAttemptWindow without failures.
+var (
+	loginBackoffBase     = getEnvDuration("LOGIN_BACKOFF_BASE", time.Second)
+	loginLockoutDuration = getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	loginAttemptWindow   = getEnvDuration("LOGIN_ATTEMPT_WINDOW", time.Hour)
+
+	accountThrottle = LoginThrottlePolicy{
+		FreeAttempts:    getEnvInt("LOGIN_ACCOUNT_FREE_ATTEMPTS", 3),
+		Threshold:       getEnvInt("LOGIN_ACCOUNT_LOCKOUT_THRESHOLD", 10),
+		BaseDelay:       loginBackoffBase,
+		LockoutDuration: loginLockoutDuration,
+	}
+	ipThrottle = LoginThrottlePolicy{
+		FreeAttempts:    getEnvInt("LOGIN_IP_FREE_ATTEMPTS", 20),
+		Threshold:       getEnvInt("LOGIN_IP_LOCKOUT_THRESHOLD", 100),
+		BaseDelay:       loginBackoffBase,
+		LockoutDuration: loginLockoutDuration,
+	}
+)
+
+// userDeletionPolicy decides what happens to the blogs and comments of a
+// deleted user; see DeletionPolicy.
+var userDeletionPolicy = DeletionPolicy{
+	Blogs:      BlogDeletionPolicy(getEnv("USER_DELETION_BLOGS", string(BlogsDelete))),
+	Comments:   CommentDeletionPolicy(getEnv("USER_DELETION_COMMENTS", string(CommentsDelete))),
+	TransferTo: getEnv("USER_DELETION_TRANSFER_TO", ""),
+}
+
+// Deleted users, blogs and comments stay in the trash for trashRetention
+// before the purger, which runs every trashPurgeInterval, removes them.
+var (
+	trashRetention     = getEnvDuration("TRASH_RETENTION", 30*24*time.Hour)
+	trashPurgeInterval = getEnvDuration("TRASH_PURGE_INTERVAL", time.Hour)
+)
+
+// Scheduled blogs are published by a background job every publishInterval.
+var publishInterval = getEnvDuration("PUBLISH_INTERVAL", 30*time.Second)
+
+// Data exports with more than exportSyncLimit blogs and comments cannot be
+// downloaded directly; they are built in the background into exportDir and
+// can be downloaded for exportTTL.
+var (
+	exportSyncLimit       = getEnvInt("EXPORT_SYNC_LIMIT", 200)
+	exportDir             = getEnv("EXPORT_DIR", "exports")
+	exportTTL             = getEnvDuration("EXPORT_TTL", 24*time.Hour)
+	exportCleanupInterval = getEnvDuration("EXPORT_CLEANUP_INTERVAL", time.Hour)
+)
+
+// oidcProvider is nil unless single sign-on is configured; it is set up in
+// main.
+var oidcProvider *OIDCProvider
+
+// initOIDCProvider discovers the provider at OIDC_ISSUER. Single sign-on
+// stays disabled when it is not set.
+func initOIDCProvider() *OIDCProvider {
+	issuer := getEnv("OIDC_ISSUER", "")
+	if issuer == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	provider, err := DiscoverOIDCProvider(ctx, OIDCConfig{
+		Issuer:       issuer,
+		ClientID:     getEnv("OIDC_CLIENT_ID", ""),
+		ClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		RedirectURL:  getEnv("OIDC_REDIRECT_URL", appBaseURL+"/users/oidc/callback"),
+		Scopes:       strings.Fields(getEnv("OIDC_SCOPES", "openid email profile")),
+	})
+	if err != nil {
+		log.Fatal("failed to set up single sign-on: ", err)
+	}
+	return provider
+}
+
+// mailer delivers account mail; it is configured in main.
+var mailer Mailer
+
+// initMailer sends through SMTP_ADDR when set and otherwise drops messages
+// into a local outbox directory.
+func initMailer() Mailer {
+	from := getEnv("MAIL_FROM", "blog-api <no-reply@localhost>")
+	addr := getEnv("SMTP_ADDR", "")
+	if addr == "" {
+		return &OutboxMailer{Dir: getEnv("MAIL_OUTBOX_DIR", "outbox"), From: from}
+	}
+	var auth smtp.Auth
+	if username := getEnv("SMTP_USERNAME", ""); username != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		auth = smtp.PlainAuth("", username, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	return &SMTPMailer{Addr: addr, From: from, Auth: auth}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CookieConfig holds the attributes of the cookies the API sets. The
+// refresh token and sign-on state cookies are always HttpOnly; HTTPOnly
+// applies to the access token cookie, which browsers never need to read.
+type CookieConfig struct {
+	Domain   string
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid SameSite mode %q", value)
+}
+
+func initCookieConfig() CookieConfig {
+	sameSite, err := parseSameSite(getEnv("COOKIE_SAMESITE", "lax"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := CookieConfig{
+		Domain:   getEnv("COOKIE_DOMAIN", "localhost"),
+		Secure:   getEnvBool("COOKIE_SECURE", false),
+		HTTPOnly: getEnvBool("COOKIE_HTTPONLY", true),
+		SameSite: sameSite,
+	}
+	// browsers drop SameSite=None cookies that are not Secure
+	if cfg.SameSite == http.SameSiteNoneMode && !cfg.Secure {
+		log.Fatal("COOKIE_SAMESITE=none requires COOKIE_SECURE=true")
+	}
+	return cfg
+}
+
+// setCookie sets a cookie with the configured attributes. A negative
+// maxAge deletes it.
+func (cfg CookieConfig) setCookie(c *gin.Context, name, value string, maxAge int, path string, httpOnly bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    url.QueryEscape(value),
+		MaxAge:   maxAge,
+		Path:     path,
+		Domain:   cfg.Domain,
+		Secure:   cfg.Secure,
+		HttpOnly: httpOnly,
+		SameSite: cfg.SameSite,
+	})
+}
+
+// Cookie authentication is protected against cross-site request forgery
+// with double-submit tokens: every session gets a random token in a cookie
+// scripts on our origin can read, and state-changing requests must echo it
+// in the X-CSRF-Token header. Other sites can make the browser send the
+// cookie but cannot read it to set the header.
+const (
+	csrfCookieName = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+// setCSRFCookie gives the client a CSRF token. New sessions always get a
+// fresh one, so that a token planted before login is worthless; a token
+// refresh passes reuse to keep the one the client has, so that requests in
+// flight stay valid.
+func setCSRFCookie(c *gin.Context, reuse bool) error {
+	token := ""
+	if reuse {
+		token, _ = c.Cookie(csrfCookieName)
+	}
+	if token == "" {
+		var err error
+		if token, err = generateToken(32); err != nil {
+			return err
+		}
+	}
+	cookieConfig.setCookie(c, csrfCookieName, token, int(refreshTokenTTL.Seconds()), "/", false)
+	return nil
+}
+
+// validCSRF reports whether the request carries the same CSRF token in its
+// cookie and header.
+func validCSRF(c *gin.Context) bool {
+	cookie, err := c.Cookie(csrfCookieName)
+	header := c.GetHeader(csrfHeaderName)
+	if err != nil || cookie == "" || header == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
+
+// sessionCookiePresent reports whether the request carries the access or
+// refresh token cookie.
+func sessionCookiePresent(c *gin.Context) bool {
+	for _, name := range []string{"token", "refresh_token"} {
+		if value, err := c.Cookie(name); err == nil && value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// CSRFProtect rejects state-changing requests authenticated with the token
+// cookie unless they pass the double-submit check. It must run after
+// Authenticate; bearer tokens and API keys are not sent by browsers on
+// their own and need no check.
+func CSRFProtect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if safeMethod(c.Request.Method) || currentPrincipal(c).Method != AuthCookie {
+			c.Next()
+			return
+		}
+		if !validCSRF(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Error": "Missing or invalid CSRF token"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseSameSite(t *testing.T) {
+	for value, want := range map[string]http.SameSite{
+		"lax":    http.SameSiteLaxMode,
+		"Strict": http.SameSiteStrictMode,
+		"none":   http.SameSiteNoneMode,
+	} {
+		got, err := parseSameSite(value)
+		assert.NilError(t, err)
+		assert.Equal(t, want, got)
+	}
+	_, err := parseSameSite("sometimes")
+	assert.Assert(t, err != nil)
+}
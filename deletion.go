@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// BlogDeletionPolicy says what happens to a deleted user's blogs.
+type BlogDeletionPolicy string
+
+const (
+	// BlogsDelete deletes the blogs together with every comment on them.
+	BlogsDelete BlogDeletionPolicy = "delete"
+	// BlogsTransfer hands the blogs over to DeletionPolicy.TransferTo.
+	BlogsTransfer BlogDeletionPolicy = "transfer"
+)
+
+// CommentDeletionPolicy says what happens to the comments a deleted user
+// left on blogs that survive the deletion.
+type CommentDeletionPolicy string
+
+const (
+	CommentsDelete CommentDeletionPolicy = "delete"
+	// CommentsAnonymize keeps the comments but drops their author.
+	CommentsAnonymize CommentDeletionPolicy = "anonymize"
+)
+
+type DeletionPolicy struct {
+	Blogs    BlogDeletionPolicy    `json:"blogs"`
+	Comments CommentDeletionPolicy `json:"comments"`
+	// TransferTo is the name of the user who receives transferred blogs.
+	TransferTo string `json:"transfer_to,omitempty"`
+}
+
+var (
+	ErrInvalidDeletionPolicy = errors.New("invalid user deletion policy")
+	ErrTransferTarget        = errors.New("blogs cannot be transferred to that user")
+)
+
+func (p DeletionPolicy) Validate() error {
+	switch p.Blogs {
+	case BlogsDelete:
+	case BlogsTransfer:
+		if p.TransferTo == "" {
+			return fmt.Errorf("%w: transferring blogs needs a receiving user", ErrInvalidDeletionPolicy)
+		}
+	default:
+		return fmt.Errorf("%w: unknown blog policy %q", ErrInvalidDeletionPolicy, p.Blogs)
+	}
+	if p.Comments != CommentsDelete && p.Comments != CommentsAnonymize {
+		return fmt.Errorf("%w: unknown comment policy %q", ErrInvalidDeletionPolicy, p.Comments)
+	}
+	return nil
+}
+
+// DeletionReport counts the documents each step touched, by collection.
+type DeletionReport struct {
+	Deleted     map[string]int64 `json:"deleted"`
+	Transferred map[string]int64 `json:"transferred,omitempty"`
+	Anonymized  map[string]int64 `json:"anonymized,omitempty"`
+}
+
+// deleteUser removes a user and deals with everything they own according to
+// policy. The user document goes last, so a deletion that fails half way
+// can simply be run again.
+func deleteUser(ctx context.Context, userID primitive.ObjectID, policy DeletionPolicy) (DeletionReport, error) {
+	report := newDeletionReport()
+	if err := policy.Validate(); err != nil {
+		return report, err
+	}
+	var user User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"_id": userID}).Decode(&user); err != nil {
+		return report, err
+	}
+
+	var err error
+	if policy.Blogs == BlogsTransfer {
+		err = transferBlogs(ctx, user, policy.TransferTo, &report)
+	} else {
+		err = deleteOwnedBlogs(ctx, user, &report)
+	}
+	if err != nil {
+		return report, err
+	}
+	if policy.Comments == CommentsAnonymize {
+		err = anonymizeComments(ctx, user, &report)
+	} else {
+		err = deleteAuthoredComments(ctx, user, &report)
+	}
+	if err != nil {
+		return report, err
+	}
+	if err := deleteCredentials(ctx, user, &report); err != nil {
+		return report, err
+	}
+	if err := deleteFollows(ctx, user, &report); err != nil {
+		return report, err
+	}
+	if err := deleteExports(ctx, user, &report); err != nil {
+		return report, err
+	}
+
+	result, err := db.Collection("users").DeleteOne(ctx, bson.M{"_id": user.ID})
+	if err != nil {
+		return report, err
+	}
+	report.Deleted["users"] = result.DeletedCount
+	return report, nil
+}
+
+// previewUserDeletion counts what deleteUser would do to the user's blogs
+// and comments if they were deleted under policy now.
+func previewUserDeletion(ctx context.Context, userID primitive.ObjectID, policy DeletionPolicy) (DeletionReport, error) {
+	report := newDeletionReport()
+	blogIDs, err := ownedBlogIDs(ctx, userID)
+	if err != nil {
+		return report, err
+	}
+	authored := bson.M{"author_id": userID}
+	if policy.Blogs == BlogsTransfer {
+		report.Transferred["blogrecords"] = int64(len(blogIDs))
+		if report.Transferred["blogs"], err = db.Collection("blogs").CountDocuments(ctx, bson.M{"author_id": userID}); err != nil {
+			return report, err
+		}
+	} else {
+		report.Deleted["blogs"] = int64(len(blogIDs))
+		report.Deleted["blogrecords"] = int64(len(blogIDs))
+		if report.Deleted["comments"], err = db.Collection("comments").CountDocuments(ctx, bson.M{"blog_id": bson.M{"$in": blogIDs}}); err != nil {
+			return report, err
+		}
+		// comments on the user's own blogs go with them
+		authored["blog_id"] = bson.M{"$nin": blogIDs}
+	}
+	comments, err := db.Collection("comments").CountDocuments(ctx, authored)
+	if err != nil {
+		return report, err
+	}
+	if policy.Comments == CommentsAnonymize {
+		report.Anonymized["comments"] = comments
+	} else {
+		report.Deleted["comments"] += comments
+	}
+	report.Deleted["users"] = 1
+	return report, nil
+}
+
+func ownedBlogIDs(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	cursor, err := db.Collection("blogrecords").Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	records := []BlogRecord{}
+	if err = cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(records))
+	for i, record := range records {
+		ids[i] = record.BlogID
+	}
+	return ids, nil
+}
+
+func transferBlogs(ctx context.Context, user User, to string, report *DeletionReport) error {
+	var target User
+	if err := db.Collection("users").FindOne(ctx, bson.M{"name": to, "deleted_at": notDeleted}).Decode(&target); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return fmt.Errorf("%w: no user named %q", ErrTransferTarget, to)
+		}
+		return err
+	}
+	if target.ID == user.ID {
+		return fmt.Errorf("%w: the user being deleted", ErrTransferTarget)
+	}
+	update := bson.M{"$set": bson.M{"user_id": target.ID}}
+	result, err := db.Collection("blogrecords").UpdateMany(ctx, bson.M{"user_id": user.ID}, update)
+	if err != nil {
+		return err
+	}
+	report.Transferred["blogrecords"] = result.ModifiedCount
+	result, err = db.Collection("blogs").UpdateMany(ctx, bson.M{"author_id": user.ID}, bson.M{"$set": bson.M{"author_id": target.ID}})
+	if err != nil {
+		return err
+	}
+	report.Transferred["blogs"] = result.ModifiedCount
+	return nil
+}
+
+// deleteOwnedBlogs deletes the user's blogs with all comments on them,
+// whoever wrote those.
+func deleteOwnedBlogs(ctx context.Context, user User, report *DeletionReport) error {
+	blogIDs, err := ownedBlogIDs(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	cursor, err := db.Collection("blogs").Find(ctx, bson.M{"_id": bson.M{"$in": blogIDs}})
+	if err != nil {
+		return err
+	}
+	blogs := []Blog{}
+	if err = cursor.All(ctx, &blogs); err != nil {
+		return err
+	}
+	commentIDs := []primitive.ObjectID{}
+	for _, blog := range blogs {
+		commentIDs = append(commentIDs, blog.Comments...)
+	}
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"_id": bson.M{"$in": commentIDs}},
+		bson.M{"blog_id": bson.M{"$in": blogIDs}},
+	}}
+	result, err := db.Collection("comments").DeleteMany(ctx, filter)
+	if err != nil {
+		return err
+	}
+	report.Deleted["comments"] += result.DeletedCount
+
+	result, err = db.Collection("blogs").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": blogIDs}})
+	if err != nil {
+		return err
+	}
+	report.Deleted["blogs"] = result.DeletedCount
+
+	result, err = db.Collection("blogrevisions").DeleteMany(ctx, bson.M{"blog_id": bson.M{"$in": blogIDs}})
+	if err != nil {
+		return err
+	}
+	report.Deleted["blogrevisions"] = result.DeletedCount
+
+	result, err = db.Collection("blogrecords").DeleteMany(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		return err
+	}
+	report.Deleted["blogrecords"] = result.DeletedCount
+	return nil
+}
+
+func authoredCommentIDs(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	cursor, err := db.Collection("comments").Find(ctx, bson.M{"author_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	comments := []Comment{}
+	if err = cursor.All(ctx, &comments); err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, len(comments))
+	for i, comment := range comments {
+		ids[i] = comment.ID
+	}
+	return ids, nil
+}
+
+// deleteAuthoredComments deletes the user's remaining comments and takes
+// them off the blogs they were left on.
+func deleteAuthoredComments(ctx context.Context, user User, report *DeletionReport) error {
+	commentIDs, err := authoredCommentIDs(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	if len(commentIDs) == 0 {
+		return nil
+	}
+	filter := bson.M{"comments": bson.M{"$in": commentIDs}}
+	update := bson.M{"$pull": bson.M{"comments": bson.M{"$in": commentIDs}}}
+	if _, err := db.Collection("blogs").UpdateMany(ctx, filter, update); err != nil {
+		return err
+	}
+	result, err := db.Collection("comments").DeleteMany(ctx, bson.M{"_id": bson.M{"$in": commentIDs}})
+	if err != nil {
+		return err
+	}
+	report.Deleted["comments"] += result.DeletedCount
+	return nil
+}
+
+func anonymizeComments(ctx context.Context, user User, report *DeletionReport) error {
+	update := bson.M{"$unset": bson.M{"author_id": ""}}
+	result, err := db.Collection("comments").UpdateMany(ctx, bson.M{"author_id": user.ID}, update)
+	if err != nil {
+		return err
+	}
+	report.Anonymized["comments"] = result.ModifiedCount
+	return nil
+}
+
+// deleteCredentials removes everything that could still authenticate as
+// the user or refers to their account.
+func deleteCredentials(ctx context.Context, user User, report *DeletionReport) error {
+	for _, collection := range []string{"sessions", "refreshtokens", "apikeys", "actiontokens"} {
+		result, err := db.Collection(collection).DeleteMany(ctx, bson.M{"user_id": user.ID})
+		if err != nil {
+			return err
+		}
+		report.Deleted[collection] = result.DeletedCount
+	}
+	result, err := db.Collection("loginattempts").DeleteOne(ctx, bson.M{"_id": accountThrottleKey(user.Name)})
+	if err != nil {
+		return err
+	}
+	report.Deleted["loginattempts"] = result.DeletedCount
+	return nil
+}
+
+// deleteExports removes the user's data exports and their archives.
+func deleteExports(ctx context.Context, user User, report *DeletionReport) error {
+	removed, err := removeExports(ctx, bson.M{"user_id": user.ID})
+	report.Deleted["exports"] = removed
+	return err
+}
+
+func deleteFollows(ctx context.Context, user User, report *DeletionReport) error {
+	filter := bson.M{"$or": bson.A{bson.M{"follower_id": user.ID}, bson.M{"followee_id": user.ID}}}
+	result, err := db.Collection("follows").DeleteMany(ctx, filter)
+	if err != nil {
+		return err
+	}
+	report.Deleted["follows"] = result.DeletedCount
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestDeletionPolicyValidate(t *testing.T) {
+	valid := []DeletionPolicy{
+		{Blogs: BlogsDelete, Comments: CommentsDelete},
+		{Blogs: BlogsDelete, Comments: CommentsAnonymize},
+		{Blogs: BlogsTransfer, Comments: CommentsAnonymize, TransferTo: "archive"},
+	}
+	for _, policy := range valid {
+		assert.NilError(t, policy.Validate())
+	}
+	invalid := []DeletionPolicy{
+		{Blogs: BlogsTransfer, Comments: CommentsDelete},
+		{Blogs: "keep", Comments: CommentsDelete},
+		{Blogs: BlogsDelete, Comments: "hide"},
+		{},
+	}
+	for _, policy := range invalid {
+		assert.Assert(t, errors.Is(policy.Validate(), ErrInvalidDeletionPolicy), "%+v", policy)
+	}
+}
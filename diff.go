@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// maxDiffCells bounds the table computeDiff builds, the product of the
+// token counts left after trimming the common prefix and suffix.
+const maxDiffCells = 4_000_000
+
+var ErrDiffTooLarge = errors.New("texts too large to diff")
+
+type DiffMode string
+
+const (
+	DiffLines DiffMode = "line"
+	DiffWords DiffMode = "word"
+)
+
+type DiffOpKind string
+
+const (
+	DiffEqual  DiffOpKind = "equal"
+	DiffInsert DiffOpKind = "insert"
+	DiffDelete DiffOpKind = "delete"
+)
+
+// DiffOp is a run of text that both versions share, or that only the newer
+// (insert) or older (delete) one has.
+type DiffOp struct {
+	Op   DiffOpKind `json:"op"`
+	Text string     `json:"text"`
+}
+
+// splitLines splits text into lines that keep their line break.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// splitWords splits text into words and the whitespace between them, so
+// that joining the tokens gives back text.
+func splitWords(text string) []string {
+	var tokens []string
+	start, space := 0, false
+	for i, r := range text {
+		if i > start && unicode.IsSpace(r) != space {
+			tokens = append(tokens, text[start:i])
+			start = i
+		}
+		space = unicode.IsSpace(r)
+	}
+	if start < len(text) {
+		tokens = append(tokens, text[start:])
+	}
+	return tokens
+}
+
+// computeDiff returns the changes that turn from into to, compared line by
+// line or word by word.
+func computeDiff(from, to string, mode DiffMode) ([]DiffOp, error) {
+	split := splitLines
+	if mode == DiffWords {
+		split = splitWords
+	}
+	a, b := split(from), split(to)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if (len(midA)+1)*(len(midB)+1) > maxDiffCells {
+		return nil, ErrDiffTooLarge
+	}
+
+	var ops []DiffOp
+	add := func(kind DiffOpKind, text string) {
+		if n := len(ops); n > 0 && ops[n-1].Op == kind {
+			ops[n-1].Text += text
+			return
+		}
+		ops = append(ops, DiffOp{Op: kind, Text: text})
+	}
+	if prefix > 0 {
+		add(DiffEqual, strings.Join(a[:prefix], ""))
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// midA[i:] and midB[j:]
+	n, m := len(midA), len(midB)
+	lcs := make([][]int32, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if midA[i] == midB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && midA[i] == midB[j]:
+			add(DiffEqual, midA[i])
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] > lcs[i+1][j]):
+			add(DiffInsert, midB[j])
+			j++
+		default:
+			add(DiffDelete, midA[i])
+			i++
+		}
+	}
+
+	if suffix > 0 {
+		add(DiffEqual, strings.Join(a[len(a)-suffix:], ""))
+	}
+	return ops, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// applyDiff rebuilds both sides of a diff.
+func applyDiff(ops []DiffOp) (string, string) {
+	var from, to strings.Builder
+	for _, op := range ops {
+		if op.Op != DiffInsert {
+			from.WriteString(op.Text)
+		}
+		if op.Op != DiffDelete {
+			to.WriteString(op.Text)
+		}
+	}
+	return from.String(), to.String()
+}
+
+func TestComputeDiffLines(t *testing.T) {
+	from := "one\ntwo\nthree\nfour\n"
+	to := "one\n2\nthree\nfour\nfive\n"
+	ops, err := computeDiff(from, to, DiffLines)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []DiffOp{
+		{Op: DiffEqual, Text: "one\n"},
+		{Op: DiffDelete, Text: "two\n"},
+		{Op: DiffInsert, Text: "2\n"},
+		{Op: DiffEqual, Text: "three\nfour\n"},
+		{Op: DiffInsert, Text: "five\n"},
+	}, ops)
+
+	ops, err = computeDiff("same\n", "same\n", DiffLines)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []DiffOp{{Op: DiffEqual, Text: "same\n"}}, ops)
+
+	ops, err = computeDiff("", "new\n", DiffLines)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []DiffOp{{Op: DiffInsert, Text: "new\n"}}, ops)
+}
+
+func TestComputeDiffWords(t *testing.T) {
+	ops, err := computeDiff("the quick brown fox", "the slow brown  fox jumps", DiffWords)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []DiffOp{
+		{Op: DiffEqual, Text: "the "},
+		{Op: DiffDelete, Text: "quick"},
+		{Op: DiffInsert, Text: "slow"},
+		{Op: DiffEqual, Text: " brown"},
+		{Op: DiffDelete, Text: " "},
+		{Op: DiffInsert, Text: "  "},
+		{Op: DiffEqual, Text: "fox"},
+		{Op: DiffInsert, Text: " jumps"},
+	}, ops)
+	assert.DeepEqual(t, []string{"a", " ", "é", " \n", "b"}, splitWords("a é \nb"))
+}
+
+func TestComputeDiffRoundTrip(t *testing.T) {
+	from := "alpha beta\ngamma\n\ndelta epsilon\nzeta"
+	to := "alpha\nbeta gamma\n\ndelta eta\nzeta\ntheta\n"
+	for _, mode := range []DiffMode{DiffLines, DiffWords} {
+		ops, err := computeDiff(from, to, mode)
+		assert.NilError(t, err)
+		gotFrom, gotTo := applyDiff(ops)
+		assert.Equal(t, from, gotFrom)
+		assert.Equal(t, to, gotTo)
+	}
+}
+
+func TestComputeDiffTooLarge(t *testing.T) {
+	from := strings.Repeat("a\n", 3000)
+	to := strings.Repeat("b\n", 3000)
+	_, err := computeDiff(from, to, DiffLines)
+	assert.Assert(t, errors.Is(err, ErrDiffTooLarge))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Handlers never serialize the Mongo models directly; they map them to the
+// response types below so that new model fields stay private until they
+// are added here on purpose. Field names match what the API returned
+// before the response types existed.
+
+// Visibility is how much of a resource the caller may see.
+type Visibility int
+
+const (
+	VisibilityPublic Visibility = iota
+	// VisibilityOwner adds what only the resource owner should see.
+	VisibilityOwner
+	// VisibilityAdmin adds account administration details.
+	VisibilityAdmin
+)
+
+// userVisibility decides what principal may see of the user with userID.
+func userVisibility(principal Principal, userID primitive.ObjectID) Visibility {
+	if principal.Reach(PermUsersAdmin) == ReachAny {
+		return VisibilityAdmin
+	}
+	if principal.UserID == userID {
+		return VisibilityOwner
+	}
+	return VisibilityPublic
+}
+
+type PublicUser struct {
+	ID          primitive.ObjectID `json:"ID"`
+	Name        string             `json:"Name"`
+	Description string             `json:"Description"`
+	// FollowCounts is only filled in on a single user's profile.
+	*FollowCounts
+}
+
+type FollowCounts struct {
+	Followers int64 `json:"Followers"`
+	Following int64 `json:"Following"`
+}
+
+type PrivateUser struct {
+	PublicUser
+	Roles         []Role `json:"Roles"`
+	Email         string `json:"Email,omitempty"`
+	EmailVerified bool   `json:"EmailVerified"`
+	TOTPEnabled   bool   `json:"TOTPEnabled"`
+}
+
+type AdminUser struct {
+	PrivateUser
+	HasPassword       bool       `json:"HasPassword"`
+	SingleSignOn      string     `json:"SingleSignOn,omitempty"`
+	RecoveryCodesLeft int        `json:"RecoveryCodesLeft"`
+	DeletedAt         *time.Time `json:"DeletedAt,omitempty"`
+}
+
+func newPublicUser(user User) PublicUser {
+	return PublicUser{ID: user.ID, Name: user.Name, Description: user.Description}
+}
+
+// newUserResponse returns a PublicUser, PrivateUser or AdminUser for user.
+func newUserResponse(user User, visibility Visibility) interface{} {
+	return userResponse(newPublicUser(user), user, visibility)
+}
+
+// newUserProfile is newUserResponse with the user's follow counts.
+func newUserProfile(user User, visibility Visibility, counts FollowCounts) interface{} {
+	public := newPublicUser(user)
+	public.FollowCounts = &counts
+	return userResponse(public, user, visibility)
+}
+
+func userResponse(public PublicUser, user User, visibility Visibility) interface{} {
+	if visibility == VisibilityPublic {
+		return public
+	}
+	private := PrivateUser{
+		PublicUser:    public,
+		Roles:         user.EffectiveRoles(),
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		TOTPEnabled:   user.TOTPEnabled,
+	}
+	if visibility == VisibilityOwner {
+		return private
+	}
+	return AdminUser{
+		PrivateUser:       private,
+		HasPassword:       user.Password != "",
+		SingleSignOn:      user.OIDCIssuer,
+		RecoveryCodesLeft: len(user.RecoveryCodes),
+		DeletedAt:         user.DeletedAt,
+	}
+}
+
+type BlogResponse struct {
+	ID            primitive.ObjectID   `json:"ID"`
+	Title         string               `json:"Title"`
+	Slug          string               `json:"Slug"`
+	Summary       string               `json:"Summary"`
+	Content       string               `json:"Content"`
+	ContentHTML   string               `json:"ContentHTML"`
+	AuthorID      primitive.ObjectID   `json:"AuthorID"`
+	Comments      []primitive.ObjectID `json:"Comments"`
+	Status        BlogStatus           `json:"Status"`
+	PublishAt     *time.Time           `json:"PublishAt,omitempty"`
+	PublishedDate time.Time            `json:"PublishedDate"`
+	UpdatedAt     time.Time            `json:"UpdatedAt"`
+	Revision      int                  `json:"Revision"`
+	DeletedAt     *time.Time           `json:"DeletedAt,omitempty"`
+}
+
+func newBlogResponse(blog Blog) BlogResponse {
+	comments := blog.Comments
+	if comments == nil {
+		comments = []primitive.ObjectID{}
+	}
+	return BlogResponse{
+		ID:            blog.ID,
+		Title:         blog.Title,
+		Slug:          blog.Slug,
+		Summary:       blog.Summary,
+		Content:       blog.Content,
+		ContentHTML:   blogHTML(blog),
+		AuthorID:      blog.AuthorID,
+		Comments:      comments,
+		Status:        blogStatus(blog),
+		PublishAt:     blog.PublishAt,
+		PublishedDate: blog.PublishedDate,
+		UpdatedAt:     blog.UpdatedAt,
+		Revision:      currentRevision(blog),
+		DeletedAt:     blog.DeletedAt,
+	}
+}
+
+// BlogDetail is a single blog with its author.
+type BlogDetail struct {
+	BlogResponse
+	Author *PublicUser `json:"Author"`
+}
+
+type CommentResponse struct {
+	ID          primitive.ObjectID `json:"ID"`
+	Text        string             `json:"Text"`
+	TextHTML    string             `json:"TextHTML"`
+	AuthorID    primitive.ObjectID `json:"AuthorID"`
+	BlogID      primitive.ObjectID `json:"BlogID"`
+	CommentDate time.Time          `json:"CommentDate"`
+	UpVote      int                `json:"UpVote"`
+	DownVote    int                `json:"DownVote"`
+	DeletedAt   *time.Time         `json:"DeletedAt,omitempty"`
+}
+
+func newCommentResponse(comment Comment) CommentResponse {
+	return CommentResponse{
+		ID:          comment.ID,
+		Text:        comment.Text,
+		TextHTML:    commentHTML(comment),
+		AuthorID:    comment.AuthorID,
+		BlogID:      comment.BlogID,
+		CommentDate: comment.CommentDate,
+		UpVote:      comment.UpVote,
+		DownVote:    comment.DownVote,
+		DeletedAt:   comment.DeletedAt,
+	}
+}
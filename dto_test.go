@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+func marshalFields(t *testing.T, v interface{}) map[string]interface{} {
+	data, err := json.Marshal(v)
+	assert.NilError(t, err)
+	fields := map[string]interface{}{}
+	assert.NilError(t, json.Unmarshal(data, &fields))
+	return fields
+}
+
+func TestUserResponseVisibility(t *testing.T) {
+	user := User{
+		ID:            primitive.NewObjectID(),
+		Name:          "jane",
+		Password:      "$argon2id$v=19$m=65536,t=3,p=2$c2FsdA$aGFzaA",
+		Description:   "writes",
+		Email:         "jane@example.com",
+		EmailVerified: true,
+		TOTPSecret:    "JBSWY3DPEHPK3PXP",
+		RecoveryCodes: []string{"a", "b"},
+	}
+
+	public := marshalFields(t, newUserResponse(user, VisibilityPublic))
+	assert.DeepEqual(t, []string{"Description", "ID", "Name"}, sortedKeys(public))
+
+	private := marshalFields(t, newUserResponse(user, VisibilityOwner))
+	assert.Equal(t, "jane@example.com", private["Email"])
+	assert.Assert(t, private["HasPassword"] == nil)
+
+	admin := marshalFields(t, newUserResponse(user, VisibilityAdmin))
+	assert.Equal(t, true, admin["HasPassword"])
+	assert.Equal(t, float64(2), admin["RecoveryCodesLeft"])
+
+	for _, fields := range []map[string]interface{}{public, private, admin} {
+		data, _ := json.Marshal(fields)
+		assert.Assert(t, !strings.Contains(string(data), "argon2id"))
+		assert.Assert(t, !strings.Contains(string(data), user.TOTPSecret))
+	}
+}
+
+func TestUserVisibility(t *testing.T) {
+	userID := primitive.NewObjectID()
+	assert.Equal(t, VisibilityPublic, userVisibility(Principal{UserID: primitive.NewObjectID(), Roles: []Role{RoleEditor}}, userID))
+	assert.Equal(t, VisibilityOwner, userVisibility(Principal{UserID: userID, Roles: []Role{RoleAuthor}}, userID))
+	assert.Equal(t, VisibilityAdmin, userVisibility(Principal{UserID: primitive.NewObjectID(), Roles: []Role{RoleAdmin}}, userID))
+	// an admin's token without the users:admin scope sees no more than anyone
+	scoped := Principal{UserID: primitive.NewObjectID(), Roles: []Role{RoleAdmin}, Scopes: []Permission{PermUsersRead}}
+	assert.Equal(t, VisibilityPublic, userVisibility(scoped, userID))
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// A data export is a zip archive of everything stored about a user:
+// profile.json, blogs.json, comments.json, sessions.json and a Markdown
+// file per blog under posts/. Small exports are downloaded right away with
+// GET; larger ones are created with POST, built in the background into
+// exportDir and kept for exportTTL.
+// A user has at most one export pending; asking again returns it.
+
+type ExportStatus string
+
+const (
+	ExportPending ExportStatus = "pending"
+	ExportReady   ExportStatus = "ready"
+	ExportFailed  ExportStatus = "failed"
+)
+
+type ExportResponse struct {
+	ID          primitive.ObjectID `json:"id"`
+	Status      ExportStatus       `json:"status"`
+	CreatedAt   time.Time          `json:"created_at"`
+	CompletedAt *time.Time         `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	Size        int64              `json:"size,omitempty"`
+	DownloadURL string             `json:"download_url,omitempty"`
+}
+
+func newExportResponse(export DataExport) ExportResponse {
+	response := ExportResponse{
+		ID:          export.ID,
+		Status:      export.Status,
+		CreatedAt:   export.CreatedAt,
+		CompletedAt: export.CompletedAt,
+		ExpiresAt:   export.ExpiresAt,
+		Size:        export.Size,
+	}
+	if export.Status == ExportReady {
+		response.DownloadURL = exportURL(export) + "/download"
+	}
+	return response
+}
+
+func exportURL(export DataExport) string {
+	return fmt.Sprintf("/users/%s/exports/%s", export.UserID.Hex(), export.ID.Hex())
+}
+
+func exportPath(exportID primitive.ObjectID) string {
+	return filepath.Join(exportDir, exportID.Hex()+".zip")
+}
+
+func exportFilename(userID primitive.ObjectID, created time.Time) string {
+	return fmt.Sprintf("export-%s-%s.zip", userID.Hex(), created.Format("20060102"))
+}
+
+// exportSize counts the blogs and comments an export of userID would hold.
+func exportSize(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	blogs, err := db.Collection("blogrecords").CountDocuments(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return 0, err
+	}
+	comments, err := db.Collection("comments").CountDocuments(ctx, bson.M{"author_id": userID})
+	return blogs + comments, err
+}
+
+// postMarkdown renders a blog as a Markdown document.
+func postMarkdown(blog Blog) string {
+	var b strings.Builder
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %s\n", blog.ID.Hex())
+	if blog.Title != "" {
+		fmt.Fprintf(&b, "title: %q\n", blog.Title)
+	}
+	if blog.Slug != "" {
+		fmt.Fprintf(&b, "slug: %s\n", blog.Slug)
+	}
+	if blog.Summary != "" {
+		fmt.Fprintf(&b, "summary: %q\n", blog.Summary)
+	}
+	fmt.Fprintf(&b, "status: %s\n", blogStatus(blog))
+	if !blog.PublishedDate.IsZero() {
+		fmt.Fprintf(&b, "published: %s\n", blog.PublishedDate.UTC().Format(time.RFC3339))
+	}
+	if !blog.UpdatedAt.IsZero() {
+		fmt.Fprintf(&b, "updated: %s\n", blog.UpdatedAt.UTC().Format(time.RFC3339))
+	}
+	if blog.DeletedAt != nil {
+		fmt.Fprintf(&b, "deleted: %s\n", blog.DeletedAt.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "comments: %d\n", len(blog.Comments))
+	b.WriteString("---\n\n")
+	if blog.Title != "" {
+		fmt.Fprintf(&b, "# %s\n\n", blog.Title)
+	}
+	b.WriteString(blog.Content)
+	if !strings.HasSuffix(blog.Content, "\n") {
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v interface{}) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeExport writes the export archive of user to w. Items in the trash
+// are included; they are still stored.
+func writeExport(ctx context.Context, w io.Writer, user User) error {
+	counts, err := followCounts(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	blogIDs, err := ownedBlogIDs(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	cursor, err := db.Collection("blogs").Find(ctx, bson.M{"_id": bson.M{"$in": blogIDs}})
+	if err != nil {
+		return err
+	}
+	blogs := []Blog{}
+	if err = cursor.All(ctx, &blogs); err != nil {
+		return err
+	}
+	cursor, err = db.Collection("comments").Find(ctx, bson.M{"author_id": user.ID})
+	if err != nil {
+		return err
+	}
+	comments := []Comment{}
+	if err = cursor.All(ctx, &comments); err != nil {
+		return err
+	}
+	cursor, err = db.Collection("sessions").Find(ctx, bson.M{"user_id": user.ID})
+	if err != nil {
+		return err
+	}
+	sessions := []Session{}
+	if err = cursor.All(ctx, &sessions); err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(w)
+	if err := writeZipJSON(archive, "profile.json", newUserProfile(user, VisibilityOwner, counts)); err != nil {
+		return err
+	}
+	blogResponses := make([]BlogResponse, len(blogs))
+	for i, blog := range blogs {
+		blogResponses[i] = newBlogResponse(blog)
+	}
+	if err := writeZipJSON(archive, "blogs.json", blogResponses); err != nil {
+		return err
+	}
+	commentResponses := make([]CommentResponse, len(comments))
+	for i, comment := range comments {
+		commentResponses[i] = newCommentResponse(comment)
+	}
+	if err := writeZipJSON(archive, "comments.json", commentResponses); err != nil {
+		return err
+	}
+	sessionResponses := make([]SessionResponse, len(sessions))
+	for i, session := range sessions {
+		sessionResponses[i] = newSessionResponse(session, "")
+	}
+	if err := writeZipJSON(archive, "sessions.json", sessionResponses); err != nil {
+		return err
+	}
+	for _, blog := range blogs {
+		f, err := archive.Create("posts/" + blog.ID.Hex() + ".md")
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, postMarkdown(blog)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// buildExport writes the archive of a background export and records the
+// outcome. The archive only appears under its final name once complete.
+func buildExport(export DataExport, user User) {
+	ctx := context.Background()
+	err := os.MkdirAll(exportDir, 0o700)
+	var size int64
+	if err == nil {
+		size, err = writeExportFile(ctx, exportPath(export.ID), user)
+	}
+	now := time.Now()
+	update := bson.M{"status": ExportReady, "completed_at": now, "size": size}
+	if err == nil {
+		// audit once the archive exists, before the export shows as ready
+		event := AuditEvent{
+			Time:      now,
+			ActorID:   export.RequesterID,
+			ActorName: export.RequesterName,
+			Action:    AuditDataExported,
+			TargetID:  export.UserID,
+			IP:        export.RequesterIP,
+			Details:   map[string]string{"export_id": export.ID.Hex()},
+		}
+		if _, err := appendAuditEvent(ctx, event); err != nil {
+			log.Printf("recording audit event %s failed: %v", event.Action, err)
+		}
+	} else {
+		log.Printf("building export %s failed: %v", export.ID.Hex(), err)
+		update = bson.M{"status": ExportFailed, "completed_at": now}
+	}
+	result, err := db.Collection("exports").UpdateByID(ctx, export.ID, bson.M{"$set": update})
+	if err != nil {
+		log.Printf("recording export %s failed: %v", export.ID.Hex(), err)
+		return
+	}
+	if result.MatchedCount == 0 {
+		// the user was deleted while the archive was being built
+		os.Remove(exportPath(export.ID))
+	}
+}
+
+func writeExportFile(ctx context.Context, path string, user User) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".export-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeExport(ctx, tmp, user); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmp.Name(), path)
+}
+
+// removeExports deletes the exports matching filter along with their
+// archives and returns how many it deleted.
+func removeExports(ctx context.Context, filter bson.M) (int64, error) {
+	cursor, err := db.Collection("exports").Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	exports := []DataExport{}
+	if err = cursor.All(ctx, &exports); err != nil {
+		return 0, err
+	}
+	var removed int64
+	for _, export := range exports {
+		if err := os.Remove(exportPath(export.ID)); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		result, err := db.Collection("exports").DeleteOne(ctx, bson.M{"_id": export.ID})
+		if err != nil {
+			return removed, err
+		}
+		removed += result.DeletedCount
+	}
+	return removed, nil
+}
+
+// removeExpiredExports deletes background exports past their expiry along
+// with their archives.
+func removeExpiredExports(ctx context.Context, now time.Time) error {
+	_, err := removeExports(ctx, bson.M{"expires_at": bson.M{"$lte": now}})
+	return err
+}
+
+// resumePendingExports builds the exports that were still pending when the
+// server stopped. Exports of users that are gone are marked failed.
+func resumePendingExports(ctx context.Context, now time.Time) error {
+	filter := bson.M{"status": ExportPending, "expires_at": bson.M{"$gt": now}}
+	cursor, err := db.Collection("exports").Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	exports := []DataExport{}
+	if err = cursor.All(ctx, &exports); err != nil {
+		return err
+	}
+	for _, export := range exports {
+		var user User
+		err := db.Collection("users").FindOne(ctx, bson.M{"_id": export.UserID, "deleted_at": notDeleted}).Decode(&user)
+		if err == mongo.ErrNoDocuments {
+			update := bson.M{"$set": bson.M{"status": ExportFailed, "completed_at": now}}
+			_, err = db.Collection("exports").UpdateByID(ctx, export.ID, update)
+		}
+		if err != nil {
+			return err
+		}
+		if !user.ID.IsZero() {
+			buildExport(export, user)
+		}
+	}
+	return nil
+}
+
+// runExportCleaner resumes the exports a restart interrupted, then removes
+// expired exports every interval.
+func runExportCleaner(interval time.Duration) {
+	if err := resumePendingExports(context.Background(), time.Now()); err != nil {
+		log.Println("resuming pending exports failed:", err)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := removeExpiredExports(context.Background(), time.Now()); err != nil {
+			log.Println("removing expired exports failed:", err)
+		}
+	}
+}
+
+// pendingExport returns the export of userID that is still being built.
+func pendingExport(ctx context.Context, userID primitive.ObjectID) (DataExport, error) {
+	var export DataExport
+	err := db.Collection("exports").FindOne(ctx, bson.M{"user_id": userID, "status": ExportPending}).Decode(&export)
+	return export, err
+}
+
+// export handlers
+
+// exportUser loads the user of the route for an export.
+func exportUser(c *gin.Context) (User, bool) {
+	var user User
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return user, false
+	}
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"_id": userId, "deleted_at": notDeleted}).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+			return user, false
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return user, false
+	}
+	return user, true
+}
+
+// ExportUserData sends the user's data export as a zip download. Exports
+// too large for that are built in the background with CreateExport.
+func ExportUserData(c *gin.Context) {
+	user, ok := exportUser(c)
+	if !ok {
+		return
+	}
+	size, err := exportSize(context.TODO(), user.ID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if size > int64(exportSyncLimit) {
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": "Export too large to download directly, create it with POST " + c.Request.URL.Path})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(user.ID, time.Now())))
+	c.Status(http.StatusOK)
+	// the status is sent with the first byte, so a failure can only cut the
+	// download short
+	if err := writeExport(context.TODO(), c.Writer, user); err != nil {
+		log.Println("writing export failed:", err)
+		c.Abort()
+		return
+	}
+	recordAudit(c, AuditEvent{Action: AuditDataExported, TargetID: user.ID})
+}
+
+// CreateExport starts building the user's data export in the background.
+// An export already being built is returned instead of starting another.
+// The export is audited when it is ready.
+func CreateExport(c *gin.Context) {
+	user, ok := exportUser(c)
+	if !ok {
+		return
+	}
+	principal := currentPrincipal(c)
+	now := time.Now()
+	export := DataExport{
+		ID:            primitive.NewObjectID(),
+		UserID:        user.ID,
+		Status:        ExportPending,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(exportTTL),
+		RequesterID:   principal.UserID,
+		RequesterName: principal.Name,
+		RequesterIP:   c.ClientIP(),
+	}
+	_, err := db.Collection("exports").InsertOne(context.TODO(), export)
+	switch {
+	case err == nil:
+		go buildExport(export, user)
+	case mongo.IsDuplicateKeyError(err):
+		if export, err = pendingExport(context.TODO(), user.ID); err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+			return
+		}
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.Header("Location", exportURL(export))
+	c.IndentedJSON(http.StatusAccepted, newExportResponse(export))
+}
+
+// findExport loads the export named by the route for the user of the route.
+func findExport(c *gin.Context) (DataExport, bool) {
+	var export DataExport
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return export, false
+	}
+	exportId, err := primitive.ObjectIDFromHex(c.Param("export_id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return export, false
+	}
+	filter := bson.M{"_id": exportId, "user_id": userId, "expires_at": bson.M{"$gt": time.Now()}}
+	if err := db.Collection("exports").FindOne(context.TODO(), filter).Decode(&export); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Export not found"})
+			return export, false
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return export, false
+	}
+	return export, true
+}
+
+func GetExportStatus(c *gin.Context) {
+	export, ok := findExport(c)
+	if !ok {
+		return
+	}
+	c.IndentedJSON(http.StatusOK, newExportResponse(export))
+}
+
+func DownloadExport(c *gin.Context) {
+	export, ok := findExport(c)
+	if !ok {
+		return
+	}
+	if export.Status != ExportReady {
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": "Export is not ready", "status": export.Status})
+		return
+	}
+	c.FileAttachment(exportPath(export.ID), exportFilename(export.UserID, export.CreatedAt))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+func TestPostMarkdown(t *testing.T) {
+	published := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	blog := Blog{ID: primitive.NewObjectID(), Content: "# Hello\n\nworld", PublishedDate: published}
+	md := postMarkdown(blog)
+	assert.Assert(t, strings.HasPrefix(md, "---\nid: "+blog.ID.Hex()+"\n"))
+	assert.Assert(t, strings.Contains(md, "published: 2024-03-01T12:00:00Z\n"))
+	assert.Assert(t, !strings.Contains(md, "deleted:"))
+	assert.Assert(t, strings.HasSuffix(md, "---\n\n# Hello\n\nworld\n"))
+
+	deleted := published.Add(time.Hour)
+	blog.DeletedAt = &deleted
+	assert.Assert(t, strings.Contains(postMarkdown(blog), "deleted: 2024-03-01T13:00:00Z\n"))
+
+	blog.Title = `Say "hi"`
+	blog.Slug = "say-hi"
+	md = postMarkdown(blog)
+	assert.Assert(t, strings.Contains(md, "title: \"Say \\\"hi\\\"\"\nslug: say-hi\n"))
+	assert.Assert(t, strings.Contains(md, "---\n\n# Say \"hi\"\n\n# Hello"))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FeedEntry is a blog in the home feed together with its author.
+type FeedEntry struct {
+	BlogResponse
+	Author PublicUser `json:"Author"`
+}
+
+// followEntry is a follow joined with the user on its other side.
+type followEntry struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	CreatedAt time.Time          `bson:"created_at"`
+	User      User               `bson:"user"`
+}
+
+// feedEntry is a blog record joined with its blog and author.
+type feedEntry struct {
+	Blog   Blog `bson:"blog"`
+	Author User `bson:"author"`
+	// SortDate is what listBlogs orders by; see blogSortDate.
+	SortDate time.Time `bson:"sort_date"`
+}
+
+// activeUsersStage joins the users on field into "user" and drops follows of
+// users that are in the trash.
+func activeUsersStage(field string) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{"from": "users", "localField": field, "foreignField": "_id", "as": "user"}}},
+		{{Key: "$unwind", Value: "$user"}},
+		{{Key: "$match", Value: bson.M{"user.deleted_at": notDeleted}}},
+	}
+}
+
+// countFollows counts the follows matching match whose user on field is not
+// in the trash.
+func countFollows(ctx context.Context, match bson.M, field string) (int64, error) {
+	pipeline := append(mongo.Pipeline{{{Key: "$match", Value: match}}}, activeUsersStage(field)...)
+	pipeline = append(pipeline, bson.D{{Key: "$count", Value: "n"}})
+	cursor, err := db.Collection("follows").Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	var result []struct {
+		N int64 `bson:"n"`
+	}
+	if err = cursor.All(ctx, &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].N, nil
+}
+
+func followCounts(ctx context.Context, userID primitive.ObjectID) (FollowCounts, error) {
+	var counts FollowCounts
+	var err error
+	if counts.Followers, err = countFollows(ctx, bson.M{"followee_id": userID}, "follower_id"); err != nil {
+		return counts, err
+	}
+	counts.Following, err = countFollows(ctx, bson.M{"follower_id": userID}, "followee_id")
+	return counts, err
+}
+
+// followedAuthors returns the IDs of the users userID follows, leaving out
+// those in the trash.
+func followedAuthors(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	ids, err := db.Collection("follows").Distinct(ctx, "followee_id", bson.M{"follower_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}, "deleted_at": notDeleted}
+	cursor, err := db.Collection("users").Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	authors := make([]primitive.ObjectID, len(users))
+	for i, user := range users {
+		authors[i] = user.ID
+	}
+	return authors, nil
+}
+
+func FollowUser(c *gin.Context) {
+	principal := currentPrincipal(c)
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	if userId == principal.UserID {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "You cannot follow yourself"})
+		return
+	}
+	count, err := db.Collection("users").CountDocuments(context.TODO(), bson.M{"_id": userId, "deleted_at": notDeleted})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if count == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	filter := bson.M{"follower_id": principal.UserID, "followee_id": userId}
+	update := bson.M{"$setOnInsert": bson.M{"created_at": time.Now()}}
+	_, err = db.Collection("follows").UpdateOne(context.TODO(), filter, update, options.Update().SetUpsert(true))
+	// a concurrent follow of the same user wins the unique index
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Following user"})
+}
+
+func UnfollowUser(c *gin.Context) {
+	principal := currentPrincipal(c)
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	filter := bson.M{"follower_id": principal.UserID, "followee_id": userId}
+	result, err := db.Collection("follows").DeleteOne(context.TODO(), filter)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if result.DeletedCount == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Not following this user"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Unfollowed user"})
+}
+
+// listFollows answers with a page of the users on field of the follows
+// where the user of the route is on the other side, newest first.
+func listFollows(c *gin.Context, userField, otherField string) {
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	after, limit, err := pageParams(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
+	}
+	match := bson.M{otherField: userId}
+	total, err := countFollows(context.TODO(), match, userField)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if after != nil {
+		match = bson.M{"$and": bson.A{match, after.after("created_at", "_id")}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}}},
+	}
+	pipeline = append(pipeline, activeUsersStage(userField)...)
+	pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit + 1}})
+	cursor, err := db.Collection("follows").Aggregate(context.TODO(), pipeline)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	entries := []followEntry{}
+	if err = cursor.All(context.TODO(), &entries); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	next := ""
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		next = pageCursor{Time: last.CreatedAt, ID: last.ID}.String()
+	}
+	users := make([]PublicUser, len(entries))
+	for i, entry := range entries {
+		users[i] = newPublicUser(entry.User)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"count": total, "users": users, "next_cursor": next})
+}
+
+func ListFollowers(c *gin.Context) {
+	listFollows(c, "follower_id", "followee_id")
+}
+
+func ListFollowing(c *gin.Context) {
+	listFollows(c, "followee_id", "follower_id")
+}
+
+// Feed lists the blogs of the authors the caller follows, newest first.
+// Pass the returned next_cursor as cursor to get the following page.
+func Feed(c *gin.Context) {
+	principal := currentPrincipal(c)
+	after, limit, err := pageParams(c)
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
+	}
+	authors, err := followedAuthors(context.TODO(), principal.UserID)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	feed, next, err := listBlogs(context.TODO(), bson.M{"user_id": bson.M{"$in": authors}}, publicBlogFilter("blog.", time.Now()), after, limit)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"blogs": feed, "next_cursor": next})
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -16,6 +17,7 @@ import (
 type RegisterRequest struct {
 	Username    string `json:"username" binding:"required"`
 	Password    string `json:"password" binding:"required"`
+	Email       string `json:"email" binding:"required,email"`
 	Description string `json:"description" binding:"required"`
 }
 
@@ -23,6 +25,13 @@ type LoginRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
 }
+type RolesRequest struct {
+	Roles []Role `json:"roles" binding:"required"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
 type replyJson struct {
 	DeletedCount int
 }
@@ -31,19 +40,57 @@ type CommentRequest struct {
 }
 
 type BlogRequest struct {
+	Title   string `json:"title" binding:"max=200"`
+	Summary string `json:"summary" binding:"max=500"`
 	Content string `json:"content" binding:"required"`
+	// Status defaults to published, or to scheduled when PublishAt is set.
+	Status    BlogStatus `json:"status"`
+	PublishAt *time.Time `json:"publish_at"`
 }
 
-func authenticateUser(c *gin.Context) (string, error) {
-	token, err := c.Cookie("token")
+// startSession records a new session for user and hands the client an
+// access token and the first refresh token of the session.
+func startSession(c *gin.Context, user User) error {
+	session, err := createSession(context.TODO(), user.ID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		return err
+	}
+	tokenString, err := CreateToken(user, session.ID.Hex())
+	if err != nil {
+		return err
+	}
+	refreshToken, err := issueRefreshToken(context.TODO(), user.ID, session.ID)
 	if err != nil {
-		return "", err
+		return err
+	}
+	return setTokenCookies(c, tokenString, refreshToken, false)
+}
+
+// setTokenCookies sets the token cookies and the CSRF token, keeping the
+// client's CSRF token when reuseCSRF is set; see setCSRFCookie.
+func setTokenCookies(c *gin.Context, accessToken string, refreshToken string, reuseCSRF bool) error {
+	cookieConfig.setCookie(c, "token", accessToken, int(accessTokenTTL.Seconds()), "/", cookieConfig.HTTPOnly)
+	cookieConfig.setCookie(c, "refresh_token", refreshToken, int(refreshTokenTTL.Seconds()), "/users", true)
+	return setCSRFCookie(c, reuseCSRF)
+}
+
+func clearTokenCookies(c *gin.Context) {
+	cookieConfig.setCookie(c, "token", "", -1, "/", cookieConfig.HTTPOnly)
+	cookieConfig.setCookie(c, "refresh_token", "", -1, "/users", true)
+	cookieConfig.setCookie(c, csrfCookieName, "", -1, "/", false)
+}
+
+// refreshTokenFromRequest reads the refresh token from its cookie, falling
+// back to the JSON body for clients that do not keep cookies.
+func refreshTokenFromRequest(c *gin.Context) string {
+	if token, err := c.Cookie("refresh_token"); err == nil && token != "" {
+		return token
 	}
-	var user string
-	if err, user = VerifyToken(token); err != nil {
-		return "", err
+	req := RefreshRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		return ""
 	}
-	return user, nil
+	return req.RefreshToken
 }
 
 // user specific handlers
@@ -67,13 +114,40 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	md5Password := fmt.Sprintf("%X", md5.Sum([]byte(req.Password)))
-	user = User{Name: req.Username, Password: md5Password, Description: req.Description}
-	_, err := db.Collection("users").InsertOne(context.TODO(), user)
+	email := normalizeEmail(req.Email)
+	count, err := db.Collection("users").CountDocuments(context.TODO(), bson.M{"email": email})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if count > 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Email already registered, choose a different address."})
+		return
+	}
+
+	hashedPassword, err := passwordHasher.Hash(req.Password)
 	if err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "User not Registered"})
+		return
 	}
-	c.IndentedJSON(http.StatusCreated, gin.H{"Message": "User Registered successful"})
+	user = User{Name: req.Username, Password: hashedPassword, Description: req.Description, Roles: []Role{defaultRole}, Email: email}
+	resp, err := db.Collection("users").InsertOne(context.TODO(), user)
+	if mongo.IsDuplicateKeyError(err) {
+		// the name or address was taken since the checks above
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Username or email already registered, choose a different one."})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "User not Registered"})
+		return
+	}
+	user.ID = resp.InsertedID.(primitive.ObjectID)
+	recordAudit(c, AuditEvent{Action: AuditRegister, ActorID: user.ID, ActorName: user.Name})
+	if err := sendVerificationEmail(context.TODO(), user); err != nil {
+		// the user can ask for another one
+		log.Println("sending verification email failed:", err)
+	}
+	c.IndentedJSON(http.StatusCreated, gin.H{"Message": "User Registered successful, check your email to verify your address"})
 }
 
 func Login(c *gin.Context) {
@@ -84,146 +158,313 @@ func Login(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	md5Password := fmt.Sprintf("%X", md5.Sum([]byte(req.Password)))
+	throttleKeys := loginThrottleKeys(req.Username, c.ClientIP())
+	if !checkLoginThrottle(c, throttleKeys) {
+		return
+	}
 	// fetching info
-	searchFilter := bson.D{{"name", req.Username}}
+	searchFilter := bson.M{"name": req.Username, "deleted_at": notDeleted}
 	var user User
 	if err := db.Collection("users").FindOne(context.TODO(), searchFilter).Decode(&user); err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Invalid username or password"})
+		// unknown users cost the same time and get the same answer
+		burnPasswordCheck(req.Password)
+		recordLoginFailures(context.TODO(), throttleKeys)
+		recordAudit(c, AuditEvent{Action: AuditLoginFailed, ActorName: req.Username, Details: map[string]string{"reason": "unknown user"}})
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Invalid username or password"})
 		return
 	}
 
-	if user.Password != md5Password {
+	match, rehash, err := CheckPassword(passwordHasher, req.Password, user.Password)
+	if err != nil || !match {
+		recordLoginFailures(context.TODO(), throttleKeys)
+		recordAudit(c, AuditEvent{Action: AuditLoginFailed, ActorID: user.ID, ActorName: user.Name, Details: map[string]string{"reason": "wrong password"}})
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Invalid username or password"})
+		return
 	}
-	tokenString, err := CreateToken(req.Username)
-	if err != nil {
+	resetLoginFailures(context.TODO(), user.Name)
+	if user.Email != "" && !user.EmailVerified {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"Error": "Email address not verified"})
+		return
+	}
+	if rehash {
+		// legacy or outdated hash, replace it now that we know the password
+		if err := upgradePasswordHash(context.TODO(), user, req.Password); err != nil {
+			log.Println("password rehash failed:", err)
+		}
+	}
+	if user.TOTPEnabled {
+		startMFAChallenge(c, user)
+		return
+	}
+	if err := startSession(c, user); err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Invalid username or password"})
 		return
 	}
-	c.SetCookie("token", tokenString, 3600, "/", "localhost", false, false)
+	recordAudit(c, AuditEvent{Action: AuditLogin, ActorID: user.ID, ActorName: user.Name, Details: map[string]string{"method": "password"}})
 	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Login successful"})
 }
-func Logout(c *gin.Context) {
-	c.String(200, "logout")
+
+func upgradePasswordHash(ctx context.Context, user User, password string) error {
+	hashedPassword, err := passwordHasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	// only replace the hash we verified against, never a concurrent change
+	filter := bson.M{"_id": user.ID, "password": user.Password}
+	update := bson.M{"$set": bson.M{"password": hashedPassword}}
+	_, err = db.Collection("users").UpdateOne(ctx, filter, update)
+	return err
 }
 
-func GetAllUsers(c *gin.Context) {
-	_, err := authenticateUser(c)
+func RefreshAccessToken(c *gin.Context) {
+	// the refresh token cookie authenticates this request like the token
+	// cookie does elsewhere
+	if _, err := c.Cookie("refresh_token"); err == nil && !validCSRF(c) {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"Error": "Missing or invalid CSRF token"})
+		return
+	}
+	raw := refreshTokenFromRequest(c)
+	if raw == "" {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid refresh token"})
+		return
+	}
+	current, next, err := rotateRefreshToken(context.TODO(), raw)
 	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+		if err != ErrRefreshTokenInvalid && err != ErrRefreshTokenExpired && err != ErrRefreshTokenReused {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+			return
+		}
+		clearTokenCookies(c)
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid refresh token"})
 		return
 	}
 
-	cursor, err := db.Collection("users").Find(context.TODO(), bson.D{})
+	var user User
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"_id": current.UserID, "deleted_at": notDeleted}).Decode(&user); err != nil {
+		_ = revokeTokenFamily(context.TODO(), current.FamilyID)
+		clearTokenCookies(c)
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid refresh token"})
+		return
+	}
+	if err := extendSession(context.TODO(), current.FamilyID); err != nil {
+		log.Println("extending session failed:", err)
+	}
+	tokenString, err := CreateToken(user, current.FamilyID.Hex())
 	if err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
 		return
 	}
-	var users []User
-	if err = cursor.All(context.TODO(), &users); err != nil {
+	if err := setTokenCookies(c, tokenString, next, true); err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
 		return
 	}
-	c.IndentedJSON(http.StatusOK, users)
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Token refreshed"})
 }
 
-func GetUserByID(c *gin.Context) {
-	_, err := authenticateUser(c)
+// JWKS publishes the public keys access tokens can be verified with.
+func JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, keyRing.JWKS())
+}
+
+func Logout(c *gin.Context) {
+	// logging out is public so that it works with an expired access token,
+	// which leaves CSRF protection to this handler
+	if sessionCookiePresent(c) && !validCSRF(c) {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"Error": "Missing or invalid CSRF token"})
+		return
+	}
+	// revoke the session the access token belongs to, or failing that the
+	// one the refresh token belongs to
+	if principal, err := authenticateUser(c); err == nil && principal.SessionID != "" {
+		if familyID, err := primitive.ObjectIDFromHex(principal.SessionID); err == nil {
+			if err := revokeTokenFamily(context.TODO(), familyID); err != nil {
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+				return
+			}
+		}
+	}
+	if raw := refreshTokenFromRequest(c); raw != "" {
+		if refreshToken, err := findRefreshToken(context.TODO(), raw); err == nil {
+			if err := revokeTokenFamily(context.TODO(), refreshToken.FamilyID); err != nil {
+				c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+				return
+			}
+		}
+	}
+	clearTokenCookies(c)
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Logout successful"})
+}
+
+func GetAllUsers(c *gin.Context) {
+	cursor, err := db.Collection("users").Find(context.TODO(), bson.M{"deleted_at": notDeleted})
 	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	var users []User
+	if err = cursor.All(context.TODO(), &users); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
 		return
 	}
+	principal := currentPrincipal(c)
+	response := make([]interface{}, len(users))
+	for i, user := range users {
+		response[i] = newUserResponse(user, userVisibility(principal, user.ID))
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
 
+func GetUserByID(c *gin.Context) {
 	_id := c.Param("id")
 	userId, err := primitive.ObjectIDFromHex(_id)
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
 	}
-	searchFilter := bson.D{{"_id", userId}}
+	searchFilter := bson.M{"_id": userId, "deleted_at": notDeleted}
 	var user User
 	if err = db.Collection("users").FindOne(context.TODO(), searchFilter).Decode(&user); err != nil {
-		panic(err)
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
 	}
-	c.IndentedJSON(http.StatusOK, user)
-}
-
-func DeleteUserByID(c *gin.Context) {
-	_, err := authenticateUser(c)
+	counts, err := followCounts(context.TODO(), user.ID)
 	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
 		return
 	}
+	c.IndentedJSON(http.StatusOK, newUserProfile(user, userVisibility(currentPrincipal(c), user.ID), counts))
+}
 
+// DeleteUserByID moves a user to the trash and ends their sessions. The
+// account and what it owns are only removed when the trash is purged; the
+// reply says when, under which policy, and what that purge would remove as
+// things stand.
+func DeleteUserByID(c *gin.Context) {
 	_id := c.Param("id")
 	userId, err := primitive.ObjectIDFromHex(_id)
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
 		return
 	}
-	deleteFilter := bson.D{{"_id", userId}}
-	result, err := db.Collection("users").DeleteOne(context.TODO(), deleteFilter)
+	deletedAt := time.Now()
+	filter := bson.M{"_id": userId, "deleted_at": notDeleted}
+	update := bson.M{"$set": bson.M{"deleted_at": deletedAt}}
+	result, err := db.Collection("users").UpdateOne(context.TODO(), filter, update)
 	if err != nil {
-		panic(err)
+		respondTrashError(c, err)
+		return
 	}
-	// display the number of documents deleted
-	type replyJson struct {
-		DeletedCount int
+	if result.ModifiedCount == 0 {
+		c.IndentedJSON(http.StatusOK, replyJson{DeletedCount: 0})
+		return
 	}
-	reply := replyJson{
-		DeletedCount: int(result.DeletedCount),
+	if err := revokeUserSessions(context.TODO(), userId); err != nil {
+		log.Println("revoking sessions of deleted user failed:", err)
 	}
-	c.IndentedJSON(http.StatusOK, reply)
+	recordAudit(c, AuditEvent{Action: AuditUserDeleted, TargetID: userId})
+	pending, err := previewUserDeletion(context.TODO(), userId, userDeletionPolicy)
+	if err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"DeletedCount": int(result.ModifiedCount),
+		"purge_at":     deletedAt.Add(trashRetention),
+		"policy":       userDeletionPolicy,
+		"pending":      pending,
+	})
 }
 
-// blog specific handlers
-func GetAllBlogs(c *gin.Context) {
-	user, err := authenticateUser(c)
+func SetUserRoles(c *gin.Context) {
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
 	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
 		return
 	}
-	// find user id
-	searchFilter := bson.D{{"name", user}}
-	var userResponse User
-	if err = db.Collection("users").FindOne(context.TODO(), searchFilter).Decode(&userResponse); err != nil {
-		panic(err)
+	req := RolesRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	for _, role := range req.Roles {
+		if !validRole(role) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": fmt.Sprintf("Unknown role %q", role)})
+			return
+		}
 	}
 
-	// find user blogs records
-	filter := bson.D{{"user_id", userResponse.ID}}
-	cursor, err := db.Collection("blogrecords").Find(context.TODO(), filter)
+	update := bson.M{"$set": bson.M{"roles": req.Roles}}
+	result, err := db.Collection("users").UpdateByID(context.TODO(), userId, update)
 	if err != nil {
-		panic(err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
 	}
-	var blogsRec []BlogRecord
-	if err = cursor.All(context.TODO(), &blogsRec); err != nil {
-		panic(err)
+	// access tokens carry the old roles; end them so they are not used
+	// until they expire
+	if err := revokeUserSessions(context.TODO(), userId); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
 	}
-	arr := make([]primitive.ObjectID, 0)
-	for i := range blogsRec {
-		b := blogsRec[i]
-		arr = append(arr, b.BlogID)
+	roles := make([]string, len(req.Roles))
+	for i, role := range req.Roles {
+		roles[i] = string(role)
 	}
+	recordAudit(c, AuditEvent{Action: AuditRolesChanged, TargetID: userId, Details: map[string]string{"roles": strings.Join(roles, ",")}})
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Roles updated", "roles": req.Roles})
+}
+
+// blog specific handlers
 
-	blogFilter := bson.M{"_id": bson.M{"$in": arr}}
-	cursor, err = db.Collection("blogrecords").Find(context.TODO(), blogFilter)
+// GetAllBlogs lists blogs newest first: the caller's own by default, those
+// of one user with author=<id>, or everyone's with all=true. Drafts and
+// other unpublished blogs are only listed for their owner. Pass the
+// returned next_cursor as cursor to get the following page.
+func GetAllBlogs(c *gin.Context) {
+	principal := currentPrincipal(c)
+	after, limit, err := pageParams(c)
 	if err != nil {
-		panic(err)
-	}
-	var blogs []Blog
-	if err = cursor.All(context.TODO(), &blogs); err != nil {
-		panic(err)
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
 	}
-	c.IndentedJSON(http.StatusOK, blogs)
-}
 
-func InsertBlog(c *gin.Context) {
-	user, err := authenticateUser(c)
+	// the caller's own listing includes drafts; the others only what
+	// anyone may see
+	recordMatch := bson.M{"user_id": principal.UserID}
+	var blogMatch bson.M
+	if c.Query("all") == "true" {
+		recordMatch = bson.M{}
+		blogMatch = publicBlogFilter("blog.", time.Now())
+	} else if author := c.Query("author"); author != "" {
+		authorId, err := primitive.ObjectIDFromHex(author)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid author id"})
+			return
+		}
+		recordMatch = bson.M{"user_id": authorId}
+		if authorId != principal.UserID {
+			blogMatch = publicBlogFilter("blog.", time.Now())
+		}
+	}
+	blogs, next, err := listBlogs(context.TODO(), recordMatch, blogMatch, after, limit)
 	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
 		return
 	}
+	c.IndentedJSON(http.StatusOK, gin.H{"blogs": blogs, "next_cursor": next})
+}
+
+func InsertBlog(c *gin.Context) {
+	principal := currentPrincipal(c)
 
 	req := BlogRequest{}
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -232,28 +473,54 @@ func InsertBlog(c *gin.Context) {
 		return
 	}
 
+	status := req.Status
+	if status == "" {
+		status = BlogPublished
+		if req.PublishAt != nil {
+			status = BlogScheduled
+		}
+	}
+	if !validBlogStatus(status) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "status must be draft, scheduled, published or archived"})
+		return
+	}
+	now := time.Now()
 	blog := Blog{
+		ID:            primitive.NewObjectID(),
+		Title:         strings.TrimSpace(req.Title),
+		Summary:       strings.TrimSpace(req.Summary),
 		Content:       req.Content,
+		ContentHTML:   renderMarkdown(req.Content),
+		RenderVersion: renderVersion,
+		AuthorID:      principal.UserID,
 		Comments:      []primitive.ObjectID{},
-		PublishedDate: time.Now(),
+		Status:        status,
+		UpdatedAt:     now,
+	}
+	switch status {
+	case BlogScheduled:
+		if req.PublishAt == nil || !req.PublishAt.After(now) {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": ErrInvalidSchedule.Error()})
+			return
+		}
+		blog.PublishAt = req.PublishAt
+		blog.PublishedDate = *req.PublishAt
+	case BlogPublished:
+		blog.PublishedDate = now
+	}
+	if blog.Summary == "" {
+		blog.Summary = summarize(blog.Content)
 	}
-	respBlog, err := db.Collection("blogs").InsertOne(context.TODO(), blog)
+	blog, err := insertBlog(context.TODO(), blog)
 	if err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Some error occurred while inserting blog"})
 		return
 	}
-	blogId := respBlog.InsertedID.(primitive.ObjectID)
-
-	searchFilter := bson.D{{"name", user}}
-	var userResponse User
-	if err = db.Collection("users").FindOne(context.TODO(), searchFilter).Decode(&userResponse); err != nil {
-		panic(err)
-	}
 
 	// creating blog record
 	brecord := BlogRecord{
-		UserID: userResponse.ID,
-		BlogID: blogId,
+		UserID: principal.UserID,
+		BlogID: blog.ID,
 	}
 
 	_, err = db.Collection("blogrecords").InsertOne(context.TODO(), brecord)
@@ -261,46 +528,41 @@ func InsertBlog(c *gin.Context) {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Some error occurred while inserting blog record"})
 		return
 	}
-	c.IndentedJSON(http.StatusOK, gin.H{"message": "Blog inserted successful"})
+	c.IndentedJSON(http.StatusOK, gin.H{"message": "Blog inserted successful", "ID": blog.ID, "Slug": blog.Slug})
 }
 
+// DeleteBlogByID moves a blog to the trash together with its comments.
 func DeleteBlogByID(c *gin.Context) {
-	_, err := authenticateUser(c)
-	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
-		return
-	}
-
 	_id := c.Param("id")
 	blog_id, err := primitive.ObjectIDFromHex(_id)
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
 		return
 	}
-	deleteFilter := bson.D{{"_id", blog_id}}
-	result, err := db.Collection("blogs").DeleteOne(context.TODO(), deleteFilter)
+	count, err := trashBlog(context.TODO(), blog_id, time.Now())
 	// check for errors in the deleting
 	if err != nil {
-		panic(err)
+		respondTrashError(c, err)
+		return
+	}
+	if count > 0 {
+		recordAudit(c, AuditEvent{Action: AuditBlogDeleted, TargetID: blog_id})
 	}
 	// display the number of documents deleted
 	reply := replyJson{
-		DeletedCount: int(result.DeletedCount),
+		DeletedCount: int(count),
 	}
 	c.IndentedJSON(http.StatusOK, reply)
 }
 
 func InsertCommentsByBlogID(c *gin.Context) {
-	_, err := authenticateUser(c)
-	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
-		return
-	}
+	principal := currentPrincipal(c)
 
 	_id := c.Param("blog_id")
 	blog_id, err := primitive.ObjectIDFromHex(_id)
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
 	}
 
 	req := CommentRequest{}
@@ -310,13 +572,35 @@ func InsertCommentsByBlogID(c *gin.Context) {
 		return
 	}
 
-	// var cdate time.Time
+	searchFilter := bson.M{"_id": blog_id, "deleted_at": notDeleted}
+	var result Blog
+	if err = db.Collection("blogs").FindOne(context.TODO(), searchFilter).Decode(&result); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Couldnt Find"})
+		return
+	}
+	// unpublished blogs do not exist for those who may not see them
+	if visible, err := canSeeBlog(context.TODO(), principal, result); err != nil || !visible {
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Couldnt Find"})
+			return
+		}
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+		return
+	}
 
 	comment := Comment{
-		Text:        req.Comment,
-		CommentDate: time.Now(),
-		UpVote:      0,
-		DownVote:    0,
+		Text:          req.Comment,
+		TextHTML:      renderMarkdown(req.Comment),
+		RenderVersion: renderVersion,
+		AuthorID:      principal.UserID,
+		BlogID:        blog_id,
+		CommentDate:   time.Now(),
+		UpVote:        0,
+		DownVote:      0,
 	}
 	comment_id, err := db.Collection("comments").InsertOne(context.TODO(), comment)
 	if err != nil {
@@ -324,111 +608,119 @@ func InsertCommentsByBlogID(c *gin.Context) {
 		return
 	}
 
-	searchFilter := bson.D{{"_id", blog_id}}
-	var result Blog
-	// check for errors in the finding
-	if err = db.Collection("blogs").FindOne(context.TODO(), searchFilter).Decode(&result); err != nil {
-		panic(err)
-	}
-
-	comments := result.Comments
-	newComment, ok := comment_id.InsertedID.(primitive.ObjectID)
-	if ok {
-		comments = append(comments, newComment)
-	}
-
-	// update query
-	update := bson.D{
-		{"$set",
-			bson.D{
-				{"comments", comments},
-			},
-		},
-	}
-	// fetch blog by id and update comment into it
-	resp, err := db.Collection("blogs").UpdateByID(context.TODO(), blog_id, update)
+	newComment := comment_id.InsertedID.(primitive.ObjectID)
+	// append rather than set the list, so concurrent comments and deletions
+	// are not undone; blogs stored without comments may hold null
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{"comments": bson.M{"$concatArrays": bson.A{
+		bson.M{"$ifNull": bson.A{"$comments", bson.A{}}}, bson.A{newComment},
+	}}}}}}
+	resp, err := db.Collection("blogs").UpdateOne(context.TODO(), searchFilter, update)
 	if err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Couldnt Find"})
 		return
 	}
+	if resp.MatchedCount == 0 {
+		// the blog went to the trash in the meantime
+		_, _ = db.Collection("comments").DeleteOne(context.TODO(), bson.M{"_id": newComment})
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+		return
+	}
 	c.IndentedJSON(http.StatusOK, resp.ModifiedCount)
 }
 
 func DeleteComments(c *gin.Context) {
-	_, err := authenticateUser(c)
-	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
-		return
-	}
-
 	Id := c.Param("blog_id")
 	cId := c.Param("comment_id")
 
 	blogId, err := primitive.ObjectIDFromHex(Id)
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid blog id"})
+		return
 	}
 	commentId, err := primitive.ObjectIDFromHex(cId)
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid comment id"})
+		return
 	}
 
-	searchFilter := bson.D{{"_id", blogId}}
+	searchFilter := bson.M{"_id": blogId, "deleted_at": notDeleted}
 	var result Blog
 	if err = db.Collection("blogs").FindOne(context.TODO(), searchFilter).Decode(&result); err != nil {
-		panic(err)
-	}
-
-	comments := result.Comments
-	newComments := make([]primitive.ObjectID, 0)
-	for i := range comments {
-		if comments[i] != commentId {
-			newComments = append(newComments, comments[i])
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+			return
 		}
-	}
-
-	// update query
-	update := bson.D{
-		{"$set",
-			bson.D{
-				{"comments", newComments},
-			},
-		},
-	}
-	// fetch blog by id and update comment into it
-	_, err = db.Collection("blogs").UpdateByID(context.TODO(), blogId, update)
-	if err != nil {
 		c.IndentedJSON(http.StatusInternalServerError, gin.H{"message": "Couldnt Find"})
 		return
 	}
+	// the policy check authorized the caller against this blog, so the
+	// comment must actually belong to it
+	if !containsID(result.Comments, commentId) {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Comment not found"})
+		return
+	}
 
-	deleteFilter := bson.D{{"_id", commentId}}
-	deleteResult, err := db.Collection("comments").DeleteOne(context.TODO(), deleteFilter)
+	count, err := trashComment(context.TODO(), blogId, commentId, time.Now())
 	// check for errors in the deleting
 	if err != nil {
-		panic(err)
+		respondTrashError(c, err)
+		return
+	}
+	if count > 0 {
+		recordAudit(c, AuditEvent{Action: AuditCommentDeleted, TargetID: commentId, Details: map[string]string{"blog_id": blogId.Hex()}})
 	}
 	// display the number of documents deleted
 	reply := replyJson{
-		DeletedCount: int(deleteResult.DeletedCount),
+		DeletedCount: int(count),
 	}
 	c.IndentedJSON(http.StatusOK, reply)
 }
 
+// GetAllComments lists the comments on the blogs the caller may see.
 func GetAllComments(c *gin.Context) {
-	_, err := authenticateUser(c)
+	cursor, err := db.Collection("comments").Find(context.TODO(), bson.M{"deleted_at": notDeleted})
 	if err != nil {
-		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
 		return
 	}
+	var comments []Comment
+	if err = cursor.All(context.TODO(), &comments); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	visible, err := visibleBlogs(context.TODO(), currentPrincipal(c), comments)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	response := []CommentResponse{}
+	for _, comment := range comments {
+		if visible[comment.BlogID] {
+			response = append(response, newCommentResponse(cacheCommentHTML(context.TODO(), comment)))
+		}
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
 
-	cursor, err := db.Collection("comments").Find(context.TODO(), bson.D{})
+// visibleBlogs returns which of the blogs of comments principal may see.
+func visibleBlogs(ctx context.Context, principal Principal, comments []Comment) (map[primitive.ObjectID]bool, error) {
+	ids := bson.A{}
+	for _, comment := range comments {
+		ids = append(ids, comment.BlogID)
+	}
+	cursor, err := db.Collection("blogs").Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "deleted_at": notDeleted})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	var comments []Comment
-	if err = cursor.All(context.TODO(), &comments); err != nil {
-		panic(err)
+	var blogs []Blog
+	if err = cursor.All(ctx, &blogs); err != nil {
+		return nil, err
+	}
+	visible := make(map[primitive.ObjectID]bool, len(blogs))
+	for _, blog := range blogs {
+		if visible[blog.ID], err = canSeeBlog(ctx, principal, blog); err != nil {
+			return nil, err
+		}
 	}
-	c.IndentedJSON(http.StatusOK, comments)
+	return visible, nil
 }
@@ -1,39 +1,120 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func CreateToken(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"username": username,
-			"exp":      time.Now().Add(time.Hour * 24).Unix(),
-		})
+type TokenClaims struct {
+	Username  string `json:"username"`
+	Roles     []Role `json:"roles"`
+	SessionID string `json:"sid,omitempty"`
+	// Purpose is set on single-purpose tokens (see ActionClaims) so that
+	// they can never be used as access tokens.
+	Purpose string `json:"purpose,omitempty"`
+	jwt.StandardClaims
+}
+
+// UserID returns the ID of the user the token was issued to.
+func (c *TokenClaims) UserID() primitive.ObjectID {
+	id, _ := primitive.ObjectIDFromHex(c.Subject)
+	return id
+}
+
+func CreateToken(user User, sessionID string) (string, error) {
+	now := time.Now()
+	return signClaims(TokenClaims{
+		Username:  user.Name,
+		Roles:     user.EffectiveRoles(),
+		SessionID: sessionID,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   user.ID.Hex(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenTTL).Unix(),
+		},
+	})
+}
+
+func VerifyToken(tokenString string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	if err := parseClaims(tokenString, claims); err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, fmt.Errorf("Invalid Token")
+	}
+	// access tokens outlive a logout or revocation unless their session is
+	// checked
+	if err := checkSession(context.TODO(), claims.SessionID); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// signClaims signs claims with the active key of the key ring.
+func signClaims(claims jwt.Claims) (string, error) {
+	key := keyRing.ActiveKey()
+	if key == nil {
+		return "", ErrUnknownKey
+	}
+	token := jwt.NewWithClaims(key.signingMethod(), claims)
+	token.Header["kid"] = key.ID
 
-	tokenString, err := token.SignedString(SecretKey)
+	tokenString, err := token.SignedString(key.privateKey)
 	if err != nil {
 		return "", err
 	}
 
 	return tokenString, nil
 }
-func VerifyToken(tokenString string) (error, string) {
-	claims := jwt.MapClaims{}
+
+// parseClaims verifies tokenString against the key ring and decodes it into
+// claims.
+func parseClaims(tokenString string, claims jwt.Claims) error {
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return SecretKey, nil
+		kid, _ := token.Header["kid"].(string)
+		key, err := keyRing.VerificationKey(kid)
+		if err != nil {
+			return nil, err
+		}
+		// never let the token pick the algorithm the key is checked with
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return key.privateKey.Public(), nil
 	})
 
 	if err != nil {
-		return err, ""
+		return err
 	}
 
 	if !token.Valid {
-		return fmt.Errorf("Invalid Token"), ""
+		return fmt.Errorf("Invalid Token")
+	}
+
+	return nil
+}
+
+// generateToken returns a random URL-safe token carrying n bytes of entropy.
+func generateToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
 
-	return nil, claims["username"].(string)
+// hashToken is used to store bearer secrets (refresh tokens etc.) so that a
+// database leak does not hand out usable credentials.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
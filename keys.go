@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+type KeyStatus string
+
+const (
+	// KeyActive signs new tokens. There is exactly one active key.
+	KeyActive KeyStatus = "active"
+	// KeyRetiring no longer signs but still verifies tokens issued before
+	// the last rotation.
+	KeyRetiring KeyStatus = "retiring"
+	// KeyRetired is kept on disk for reference only.
+	KeyRetired KeyStatus = "retired"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+const keyRingManifest = "keyring.json"
+
+type SigningKey struct {
+	ID         string    `json:"kid"`
+	Algorithm  string    `json:"alg"`
+	Status     KeyStatus `json:"status"`
+	CreatedAt  time.Time `json:"created_at"`
+	privateKey crypto.Signer
+}
+
+func (k *SigningKey) signingMethod() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// KeyRing holds the keys used to sign and verify access tokens. Keys live in
+// dir as <kid>.pem PKCS#8 files next to a keyring.json manifest recording
+// their status; an empty dir keeps the ring in memory only.
+type KeyRing struct {
+	dir     string
+	mu      sync.RWMutex
+	keys    []*SigningKey
+	modTime time.Time
+}
+
+func NewKeyRing(dir string) *KeyRing {
+	return &KeyRing{dir: dir}
+}
+
+// LoadKeyRing reads the key ring stored in dir. When the directory holds no
+// keys yet, a first key using alg is generated.
+func LoadKeyRing(dir string, alg string) (*KeyRing, error) {
+	kr := NewKeyRing(dir)
+	if err := kr.reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if kr.ActiveKey() == nil {
+		if _, err := kr.Rotate(alg); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+func (kr *KeyRing) reload() error {
+	manifestPath := filepath.Join(kr.dir, keyRingManifest)
+	info, err := os.Stat(manifestPath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return err
+	}
+	var keys []*SigningKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.Status == KeyRetired {
+			continue
+		}
+		if key.privateKey, err = readPrivateKey(filepath.Join(kr.dir, key.ID+".pem")); err != nil {
+			return fmt.Errorf("key %s: %w", key.ID, err)
+		}
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = keys
+	kr.modTime = info.ModTime()
+	return nil
+}
+
+// WatchForRotation reloads the manifest whenever it changes on disk, so that
+// running servers pick up keys rotated with the rotate-keys command.
+func (kr *KeyRing) WatchForRotation(interval time.Duration) {
+	if kr.dir == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		info, err := os.Stat(filepath.Join(kr.dir, keyRingManifest))
+		if err != nil {
+			log.Println("key ring:", err)
+			continue
+		}
+		kr.mu.RLock()
+		changed := !info.ModTime().Equal(kr.modTime)
+		kr.mu.RUnlock()
+		if changed {
+			if err := kr.reload(); err != nil {
+				log.Println("key ring reload failed:", err)
+			}
+		}
+	}
+}
+
+// Rotate generates a new active key. The previous active key becomes
+// retiring and the previous retiring keys are retired.
+func (kr *KeyRing) Rotate(alg string) (*SigningKey, error) {
+	signer, err := generatePrivateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	key := &SigningKey{
+		ID:         fmt.Sprintf("%d", time.Now().UnixNano()),
+		Algorithm:  alg,
+		Status:     KeyActive,
+		CreatedAt:  time.Now().UTC(),
+		privateKey: signer,
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	keys := make([]*SigningKey, 0, len(kr.keys)+1)
+	for _, old := range kr.keys {
+		rotated := *old
+		switch old.Status {
+		case KeyActive:
+			rotated.Status = KeyRetiring
+		case KeyRetiring:
+			rotated.Status = KeyRetired
+			rotated.privateKey = nil
+		}
+		keys = append(keys, &rotated)
+	}
+	keys = append(keys, key)
+
+	if kr.dir != "" {
+		if err := writePrivateKey(filepath.Join(kr.dir, key.ID+".pem"), signer); err != nil {
+			return nil, err
+		}
+		if err := writeManifest(kr.dir, keys); err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(filepath.Join(kr.dir, keyRingManifest)); err == nil {
+			kr.modTime = info.ModTime()
+		}
+	}
+	kr.keys = keys
+	return key, nil
+}
+
+func (kr *KeyRing) ActiveKey() *SigningKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, key := range kr.keys {
+		if key.Status == KeyActive {
+			return key
+		}
+	}
+	return nil
+}
+
+// VerificationKey returns the key with the given id if it may still be used
+// to verify tokens.
+func (kr *KeyRing) VerificationKey(kid string) (*SigningKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	for _, key := range kr.keys {
+		if key.ID == kid && key.Status != KeyRetired {
+			return key, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// JWK is the public half of a signing key as published in the JWKS document.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// PublicKey decodes the key material of an RSA, P-256 or Ed25519 JWK.
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch j.KeyType {
+	case "RSA":
+		n, err := decode(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(j.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > math.MaxInt32 {
+			return nil, fmt.Errorf("jwk %s: bad RSA exponent", j.KeyID)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		if j.Curve != "P-256" {
+			return nil, fmt.Errorf("jwk %s: unsupported curve %q", j.KeyID, j.Curve)
+		}
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("jwk %s: point is not on the curve", j.KeyID)
+		}
+		return key, nil
+	case "OKP":
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if j.Curve != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwk %s: unsupported OKP key", j.KeyID)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("jwk %s: unsupported key type %q", j.KeyID, j.KeyType)
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists the public keys of every key that can still verify tokens.
+func (kr *KeyRing) JWKS() JWKSet {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range kr.keys {
+		if key.Status == KeyRetired {
+			continue
+		}
+		jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+		switch pub := key.privateKey.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func generatePrivateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported signing algorithm %q", alg)
+}
+
+func readPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return signer, nil
+}
+
+func writePrivateKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+// writeManifest replaces the manifest atomically so that watchers never read
+// a partially written file.
+func writeManifest(dir string, keys []*SigningKey) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, keyRingManifest+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, keyRingManifest))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+func TestKeyRingRotation(t *testing.T) {
+	kr := NewKeyRing("")
+	first, err := kr.Rotate("EdDSA")
+	assert.NilError(t, err)
+	second, err := kr.Rotate("EdDSA")
+	assert.NilError(t, err)
+	assert.Equal(t, second.ID, kr.ActiveKey().ID)
+
+	// the previous key still verifies until the next rotation
+	key, err := kr.VerificationKey(first.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, KeyRetiring, key.Status)
+	assert.Equal(t, 2, len(kr.JWKS().Keys))
+
+	_, err = kr.Rotate("EdDSA")
+	assert.NilError(t, err)
+	_, err = kr.VerificationKey(first.ID)
+	assert.Equal(t, ErrUnknownKey, err)
+	assert.Equal(t, 2, len(kr.JWKS().Keys))
+}
+
+func TestKeyRingPersistence(t *testing.T) {
+	dir := t.TempDir()
+	kr, err := LoadKeyRing(dir, "RS256")
+	assert.NilError(t, err)
+	active := kr.ActiveKey()
+
+	loaded, err := LoadKeyRing(dir, "RS256")
+	assert.NilError(t, err)
+	assert.Equal(t, active.ID, loaded.ActiveKey().ID)
+	assert.DeepEqual(t, kr.JWKS(), loaded.JWKS())
+}
+
+func TestTokenSignedWithRetiringKeyVerifies(t *testing.T) {
+	previous := keyRing
+	defer func() { keyRing = previous }()
+
+	keyRing = NewKeyRing("")
+	_, _ = keyRing.Rotate("RS256")
+	user := User{ID: primitive.NewObjectID(), Name: "someone"}
+	session, err := createSession(context.TODO(), user.ID, "test", "")
+	assert.NilError(t, err)
+	tokenString, err := CreateToken(user, session.ID.Hex())
+	assert.NilError(t, err)
+
+	_, _ = keyRing.Rotate("EdDSA")
+	claims, err := VerifyToken(tokenString)
+	assert.NilError(t, err)
+	assert.Equal(t, "someone", claims.Username)
+
+	_, _ = keyRing.Rotate("EdDSA")
+	_, err = VerifyToken(tokenString)
+	assert.Assert(t, err != nil)
+}
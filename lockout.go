@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginThrottlePolicy decides how long a key has to wait after a run of
+// failed logins. The first FreeAttempts failures cost nothing, each further
+// failure doubles the wait starting at BaseDelay, and from Threshold
+// failures on the key is locked for LockoutDuration.
+type LoginThrottlePolicy struct {
+	FreeAttempts    int
+	Threshold       int
+	BaseDelay       time.Duration
+	LockoutDuration time.Duration
+}
+
+func (p LoginThrottlePolicy) Delay(failures int) time.Duration {
+	if p.Threshold > 0 && failures >= p.Threshold {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.LockoutDuration; i++ {
+		delay *= 2
+	}
+	if delay > p.LockoutDuration {
+		delay = p.LockoutDuration
+	}
+	return delay
+}
+
+type loginThrottleKey struct {
+	Key    string
+	Policy LoginThrottlePolicy
+}
+
+func accountThrottleKey(username string) string {
+	return "user:" + username
+}
+
+// loginThrottleKeys are counted for every attempt. The account key does not
+// depend on whether the account exists, so a lockout reveals nothing.
+func loginThrottleKeys(username, ip string) []loginThrottleKey {
+	return []loginThrottleKey{
+		{Key: accountThrottleKey(username), Policy: accountThrottle},
+		{Key: "ip:" + ip, Policy: ipThrottle},
+	}
+}
+
+// loginRetryAfter returns how long until none of keys is locked any more,
+// or zero if a login may be attempted now.
+func loginRetryAfter(ctx context.Context, keys []loginThrottleKey, now time.Time) (time.Duration, error) {
+	ids := bson.A{}
+	for _, key := range keys {
+		ids = append(ids, key.Key)
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}, "locked_until": bson.M{"$gt": now}}
+	cursor, err := db.Collection("loginattempts").Find(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	attempts := []LoginAttempt{}
+	if err = cursor.All(ctx, &attempts); err != nil {
+		return 0, err
+	}
+	var wait time.Duration
+	for _, attempt := range attempts {
+		if d := attempt.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed attempt against key and locks it for
+// as long as its policy asks.
+func recordLoginFailure(ctx context.Context, key loginThrottleKey, now time.Time) error {
+	// a counter whose window ran out starts over; the TTL index only
+	// removes it eventually
+	update := mongo.Pipeline{bson.D{{Key: "$set", Value: bson.M{
+		"failures": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$expires_at", now}},
+			bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+			1,
+		}},
+		"last_failure_at": now,
+		"expires_at":      bson.M{"$max": bson.A{now.Add(loginAttemptWindow), "$locked_until"}},
+	}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var attempt LoginAttempt
+	err := db.Collection("loginattempts").FindOneAndUpdate(ctx, bson.M{"_id": key.Key}, update, opts).Decode(&attempt)
+	if mongo.IsDuplicateKeyError(err) {
+		// lost an upsert race with a concurrent failure, the document exists now
+		err = db.Collection("loginattempts").FindOneAndUpdate(ctx, bson.M{"_id": key.Key}, update, opts).Decode(&attempt)
+	}
+	if err != nil {
+		return err
+	}
+
+	delay := key.Policy.Delay(attempt.Failures)
+	if delay == 0 {
+		return nil
+	}
+	lockedUntil := now.Add(delay)
+	_, err = db.Collection("loginattempts").UpdateByID(ctx, key.Key, bson.M{
+		"$max": bson.M{"locked_until": lockedUntil, "expires_at": lockedUntil},
+	})
+	return err
+}
+
+func recordLoginFailures(ctx context.Context, keys []loginThrottleKey) {
+	now := time.Now()
+	for _, key := range keys {
+		if err := recordLoginFailure(ctx, key, now); err != nil {
+			log.Println("recording failed login failed:", err)
+		}
+	}
+}
+
+// resetLoginFailures forgets the failures of an account once its password
+// was given correctly. Address counters are left alone so that one known
+// password does not clear the way for guessing others.
+func resetLoginFailures(ctx context.Context, username string) {
+	if _, err := db.Collection("loginattempts").DeleteOne(ctx, bson.M{"_id": accountThrottleKey(username)}); err != nil {
+		log.Println("resetting failed logins failed:", err)
+	}
+}
+
+// checkLoginThrottle answers with 429 and returns false while any of keys
+// is locked.
+func checkLoginThrottle(c *gin.Context, keys []loginThrottleKey) bool {
+	wait, err := loginRetryAfter(context.TODO(), keys, time.Now())
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return false
+	}
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.IndentedJSON(http.StatusTooManyRequests, gin.H{"Error": "Too many failed login attempts, please try again later"})
+		return false
+	}
+	return true
+}
+
+var dummyPassword struct {
+	once sync.Once
+	hash string
+}
+
+// burnPasswordCheck does the work of a password check for a user that does
+// not exist, so that the response takes as long as for a wrong password.
+func burnPasswordCheck(password string) {
+	dummyPassword.once.Do(func() {
+		dummyPassword.hash, _ = passwordHasher.Hash("not-the-password-of-anyone")
+	})
+	_, _, _ = CheckPassword(passwordHasher, password, dummyPassword.hash)
+}
+
+// UnlockUser clears the failed login counter of an account, lifting any
+// backoff or lockout on it.
+func UnlockUser(c *gin.Context) {
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	var user User
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"_id": userId}).Decode(&user); err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if _, err := db.Collection("loginattempts").DeleteOne(context.TODO(), bson.M{"_id": accountThrottleKey(user.Name)}); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Account unlocked"})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestLoginThrottlePolicyDelay(t *testing.T) {
+	policy := LoginThrottlePolicy{FreeAttempts: 3, Threshold: 10, BaseDelay: time.Second, LockoutDuration: 15 * time.Minute}
+	expected := map[int]time.Duration{
+		0:  0,
+		3:  0,
+		4:  time.Second,
+		5:  2 * time.Second,
+		6:  4 * time.Second,
+		9:  32 * time.Second,
+		10: 15 * time.Minute,
+		50: 15 * time.Minute,
+	}
+	for failures, delay := range expected {
+		assert.Equal(t, delay, policy.Delay(failures), "failures=%d", failures)
+	}
+}
+
+func TestLoginThrottlePolicyDelayIsCapped(t *testing.T) {
+	policy := LoginThrottlePolicy{FreeAttempts: 0, BaseDelay: time.Minute, LockoutDuration: 10 * time.Minute}
+	assert.Equal(t, 8*time.Minute, policy.Delay(4))
+	assert.Equal(t, 10*time.Minute, policy.Delay(5))
+	assert.Equal(t, 10*time.Minute, policy.Delay(1000))
+}
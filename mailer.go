@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional mail such as verification and password
+// reset links.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+func formatMessage(from string, msg Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// SMTPMailer sends mail through an SMTP relay. Auth may be nil for relays
+// that do not require authentication.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, formatMessage(m.From, msg))
+}
+
+// OutboxMailer writes every message as an .eml file into Dir instead of
+// sending it. It is meant for development and tests.
+type OutboxMailer struct {
+	Dir  string
+	From string
+
+	mu  sync.Mutex
+	seq int
+}
+
+func (m *OutboxMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	m.seq++
+	name := fmt.Sprintf("%d-%04d.eml", time.Now().UnixNano(), m.seq)
+	m.mu.Unlock()
+
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMessage(m.From, msg), 0o600)
+}
+
+// Messages returns the messages in the outbox, oldest first.
+func (m *OutboxMailer) Messages() ([]Message, error) {
+	entries, err := os.ReadDir(m.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".eml") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	messages := make([]Message, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(m.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(parsed.Body)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, Message{
+			To:      parsed.Header.Get("To"),
+			Subject: parsed.Header.Get("Subject"),
+			Body:    strings.ReplaceAll(string(body), "\r\n", "\n"),
+		})
+	}
+	return messages, nil
+}
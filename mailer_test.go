@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestOutboxMailerRoundTrip(t *testing.T) {
+	outbox := &OutboxMailer{Dir: t.TempDir(), From: "blog-api <no-reply@localhost>"}
+	messages, err := outbox.Messages()
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	_ = outbox.Send(context.Background(), Message{To: "a@example.com", Subject: "first", Body: "line one\nline two\n"})
+	_ = outbox.Send(context.Background(), Message{To: "b@example.com", Subject: "second", Body: "hello"})
+
+	messages, err = outbox.Messages()
+	assert.NilError(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.DeepEqual(t, Message{To: "a@example.com", Subject: "first", Body: "line one\nline two\n"}, messages[0])
+	assert.Equal(t, "b@example.com", messages[1].To)
+}
@@ -1,30 +1,192 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 // mongo configuration
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-keys":
+			rotateKeys(os.Args[2:])
+			return
+		case "set-roles":
+			setRoles(os.Args[2:])
+			return
+		case "create-api-key":
+			createAPIKey(os.Args[2:])
+			return
+		}
+	}
+
+	keyRing = initKeyRing()
+	mailer = initMailer()
+	oidcProvider = initOIDCProvider()
+	if err := userDeletionPolicy.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ensureIndexes(db); err != nil {
+		log.Fatal("failed to create indexes: ", err)
+	}
+	go runTrashPurger(trashPurgeInterval)
+	go runExportCleaner(exportCleanupInterval)
+	go runPublisher(publishInterval)
+	r := setupRouter()
+	r.Run()
+}
+
+func setupRouter() *gin.Engine {
 	r := gin.Default()
 
-	// users
+	// public routes
 	r.POST("/users/register", Register)
 	r.POST("/users/login", Login)
-	r.GET("/users/logout", Logout)
+	r.POST("/users/login/mfa", CompleteMFALogin)
+	r.GET("/users/oidc/login", OIDCLogin)
+	r.GET("/users/oidc/callback", OIDCCallback)
+	r.POST("/users/logout", Logout)
+	r.POST("/users/token/refresh", RefreshAccessToken)
+	r.GET("/.well-known/jwks.json", JWKS)
+	r.POST("/users/email/verify/request", RequestEmailVerification)
+	r.POST("/users/email/verify/confirm", ConfirmEmailVerification)
+	r.POST("/users/password/reset/request", RequestPasswordReset)
+	r.POST("/users/password/reset/confirm", ConfirmPasswordReset)
+
+	// routes below require a valid token, cookie or API key
+	authenticated := r.Group("/", Authenticate(), CSRFProtect(), Authorize())
 
-	r.GET("/users", GetAllUsers)
-	r.GET("/users/:id", GetUserByID)
-	r.DELETE("/users/:id", DeleteUserByID)
+	// users
+	authenticated.GET("/users", GetAllUsers)
+	authenticated.GET("/users/:id", GetUserByID)
+	authenticated.DELETE("/users/:id", DeleteUserByID)
+	authenticated.PATCH("/users/:id", UpdateProfile)
+	authenticated.PUT("/users/:id/password", ChangePassword)
+	authenticated.PUT("/users/:id/username", ChangeUsername)
+	authenticated.PUT("/users/:id/roles", SetUserRoles)
+	authenticated.DELETE("/users/:id/lockout", UnlockUser)
+	authenticated.POST("/users/:id/follow", FollowUser)
+	authenticated.DELETE("/users/:id/follow", UnfollowUser)
+	authenticated.GET("/users/:id/followers", ListFollowers)
+	authenticated.GET("/users/:id/export", ExportUserData)
+	authenticated.POST("/users/:id/export", CreateExport)
+	authenticated.GET("/users/:id/exports/:export_id", GetExportStatus)
+	authenticated.GET("/users/:id/exports/:export_id/download", DownloadExport)
+	authenticated.GET("/users/:id/following", ListFollowing)
+	authenticated.GET("/users/sessions", ListSessions)
+	authenticated.DELETE("/users/sessions", RevokeOtherSessions)
+	authenticated.DELETE("/users/sessions/:id", RevokeSession)
+	authenticated.GET("/users/tokens", ListPersonalAccessTokens)
+	authenticated.POST("/users/tokens", CreatePersonalAccessToken)
+	authenticated.DELETE("/users/tokens/:id", RevokePersonalAccessToken)
+	authenticated.POST("/users/mfa/totp/enroll", EnrollTOTP)
+	authenticated.POST("/users/mfa/totp/confirm", ConfirmTOTP)
 
 	// blogs
-	r.GET("/blogs", GetAllBlogs)
-	r.POST("/blog/insert", InsertBlog)
-	r.DELETE("/blog/:id", DeleteBlogByID)
+	authenticated.GET("/feed", Feed)
+	authenticated.GET("/blogs", GetAllBlogs)
+	authenticated.GET("/blogs/:id", GetBlogByID)
+	authenticated.GET("/blogs/slug/:slug", GetBlogBySlug)
+	authenticated.POST("/blog/insert", InsertBlog)
+	authenticated.DELETE("/blog/:id", DeleteBlogByID)
+	authenticated.PUT("/blog/:id", UpdateBlog)
+	authenticated.PUT("/blog/:id/status", SetBlogStatus)
+	authenticated.GET("/blog/:id/revisions", ListRevisions)
+	authenticated.GET("/blog/:id/revisions/:rev", GetRevision)
+	authenticated.POST("/blog/:id/revisions/:rev/restore", RestoreRevision)
+	authenticated.GET("/blog/:id/diff", DiffRevisions)
 	// comments
-	r.GET("/comments/", GetAllComments)
-	r.POST("/comments/insert/:blog_id", InsertCommentsByBlogID)
-	r.DELETE("/comments/delete/:blog_id/:comment_id", DeleteComments)
-	r.Run()
+	authenticated.GET("/comments/", GetAllComments)
+	authenticated.POST("/comments/insert/:blog_id", InsertCommentsByBlogID)
+	authenticated.DELETE("/comments/delete/:blog_id/:comment_id", DeleteComments)
+
+	authenticated.GET("/audit", ListAuditEvents)
+	authenticated.GET("/audit/verify", VerifyAuditLog)
+
+	authenticated.GET("/trash/blogs", ListTrashedBlogs)
+	authenticated.POST("/trash/blogs/:id/restore", RestoreBlog)
+	authenticated.DELETE("/trash/blogs/:id", PurgeBlog)
+	authenticated.GET("/trash/comments", ListTrashedComments)
+	authenticated.POST("/trash/comments/:id/restore", RestoreComment)
+	authenticated.DELETE("/trash/comments/:id", PurgeComment)
+	authenticated.GET("/trash/users", ListTrashedUsers)
+	authenticated.POST("/trash/users/:id/restore", RestoreUser)
+	authenticated.DELETE("/trash/users/:id", PurgeUser)
+	return r
+}
+
+// rotateKeys implements `blog-app rotate-keys`: it adds a new active signing
+// key to the key ring on disk. Running servers pick it up on their own.
+func rotateKeys(args []string) {
+	fs := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	dir := fs.String("dir", getEnv("JWT_KEY_DIR", "keys"), "key ring directory")
+	alg := fs.String("alg", getEnv("JWT_KEY_ALG", "RS256"), "algorithm of the new key (RS256 or EdDSA)")
+	fs.Parse(args)
+
+	kr := NewKeyRing(*dir)
+	if err := kr.reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatal(err)
+	}
+	key, err := kr.Rotate(*alg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("new active key %s (%s)\n", key.ID, key.Algorithm)
+}
+
+// setRoles implements `blog-app set-roles <username> <role>...`, which is how
+// the first admin gets appointed.
+func setRoles(args []string) {
+	if len(args) < 2 {
+		log.Fatal("usage: set-roles <username> <role>...")
+	}
+	roles := make([]Role, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if !validRole(Role(arg)) {
+			log.Fatalf("unknown role %q", arg)
+		}
+		roles = append(roles, Role(arg))
+	}
+	filter := bson.M{"name": args[0]}
+	update := bson.M{"$set": bson.M{"roles": roles}}
+	result, err := db.Collection("users").UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if result.MatchedCount == 0 {
+		log.Fatalf("no user named %q", args[0])
+	}
+	fmt.Printf("%s now has roles %v\n", args[0], roles)
+}
+
+// createAPIKey implements `blog-app create-api-key <username> <name>`. The
+// key is printed once and cannot be recovered afterwards.
+func createAPIKey(args []string) {
+	if len(args) != 2 {
+		log.Fatal("usage: create-api-key <username> <name>")
+	}
+	var user User
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"name": args[0]}).Decode(&user); err != nil {
+		log.Fatalf("no user named %q: %v", args[0], err)
+	}
+	secret, err := generateToken(32)
+	if err != nil {
+		log.Fatal(err)
+	}
+	raw := apiKeyPrefix + secret
+	key := APIKey{UserID: user.ID, Name: args[1], KeyHash: hashToken(raw), CreatedAt: time.Now()}
+	if _, err := db.Collection("apikeys").InsertOne(context.TODO(), key); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(raw)
 }
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -20,29 +27,13 @@ import (
 )
 
 func SetUpRouter() *gin.Engine {
-	r := gin.Default()
-	r.POST("/users/register", Register)
-	r.POST("/users/login", Login)
-	r.GET("/users/logout", Logout)
-
-	r.GET("/users", GetAllUsers)
-	r.GET("/users/:id", GetUserByID)
-	r.DELETE("/users/:id", DeleteUserByID)
-
-	// blogs
-	r.GET("/blogs", GetAllBlogs)
-	r.POST("/blog/insert", InsertBlog)
-	r.DELETE("/blog/:id", DeleteBlogByID)
-	// comments
-	r.GET("/comments/", GetAllComments)
-	r.POST("/comments/insert/:blog_id", InsertCommentsByBlogID)
-	r.DELETE("/comments/delete/:blog_id/:comment_id", DeleteComments)
-	return r
+	return setupRouter()
 }
 
 var testDb *TestDatabase
 var router *gin.Engine
 var authTokenString string
+var outbox *OutboxMailer
 var testUser = map[string]string{
 	"username":    "testuser",
 	"password":    "testpassword",
@@ -52,10 +43,20 @@ var testUser = map[string]string{
 func SetUp() {
 	testDb = SetupTestDatabase()
 	router = SetUpRouter()
+	keyRing = NewKeyRing("")
+	_, _ = keyRing.Rotate("RS256")
 	// override to testdb
 	db = testDb.DbInstance
+	_ = ensureIndexes(db)
+	outboxDir, _ := os.MkdirTemp("", "blog-outbox")
+	outbox = &OutboxMailer{Dir: outboxDir}
+	mailer = outbox
+	exportDir, _ = os.MkdirTemp("", "blog-exports")
 	SetUpMockData(db)
-	authTokenString, _ = CreateToken(testUser["username"])
+	var user User
+	_ = db.Collection("users").FindOne(context.TODO(), bson.M{"name": testUser["username"]}).Decode(&user)
+	session, _ := createSession(context.TODO(), user.ID, "test", "")
+	authTokenString, _ = CreateToken(user, session.ID.Hex())
 }
 
 func TestMain(m *testing.M) {
@@ -67,6 +68,8 @@ func TestMain(m *testing.M) {
 
 func tearDown() {
 	testDb.TearDown()
+	os.RemoveAll(outbox.Dir)
+	os.RemoveAll(exportDir)
 }
 
 // helper functions
@@ -126,10 +129,95 @@ func SetUpMockData(db *mongo.Database) {
 	_, _ = db.Collection("blogs").UpdateByID(context.TODO(), blogId, update)
 }
 
+// createTestUser inserts an extra account with the given roles and returns it
+// along with an access token for it.
+func createTestUser(t *testing.T, name string, roles ...Role) (User, string) {
+	hashedPassword, _ := passwordHasher.Hash("password-" + name)
+	user := User{Name: name, Password: hashedPassword, Roles: roles}
+	resp, err := db.Collection("users").InsertOne(context.TODO(), user)
+	assert.NilError(t, err)
+	user.ID = resp.InsertedID.(primitive.ObjectID)
+	session, err := createSession(context.TODO(), user.ID, "test", "")
+	assert.NilError(t, err)
+	token, err := CreateToken(user, session.ID.Hex())
+	assert.NilError(t, err)
+	return user, token
+}
+
+// createTestBlog inserts a blog owned by owner.
+func createTestBlog(t *testing.T, owner primitive.ObjectID, content string) primitive.ObjectID {
+	resp, err := db.Collection("blogs").InsertOne(context.TODO(), Blog{Content: content, Comments: []primitive.ObjectID{}})
+	assert.NilError(t, err)
+	blogId := resp.InsertedID.(primitive.ObjectID)
+	_, err = db.Collection("blogrecords").InsertOne(context.TODO(), BlogRecord{UserID: owner, BlogID: blogId})
+	assert.NilError(t, err)
+	return blogId
+}
+
+// createTestComment attaches a comment written by author to blogId.
+func createTestComment(t *testing.T, blogId, author primitive.ObjectID, text string) primitive.ObjectID {
+	resp, err := db.Collection("comments").InsertOne(context.TODO(), Comment{Text: text, AuthorID: author, BlogID: blogId, CommentDate: time.Now()})
+	assert.NilError(t, err)
+	commentId := resp.InsertedID.(primitive.ObjectID)
+	_, err = db.Collection("blogs").UpdateByID(context.TODO(), blogId, bson.M{"$push": bson.M{"comments": commentId}})
+	assert.NilError(t, err)
+	return commentId
+}
+
+// lastTokenMailedTo returns the token in the newest outbox message sent to
+// the given address.
+func lastTokenMailedTo(t *testing.T, address string) string {
+	messages, err := outbox.Messages()
+	assert.NilError(t, err)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].To == address {
+			match := regexp.MustCompile(`token=([^\s]+)`).FindStringSubmatch(messages[i].Body)
+			assert.Assert(t, match != nil)
+			token, _ := url.QueryUnescape(match[1])
+			return token
+		}
+	}
+	t.Fatalf("no mail sent to %s", address)
+	return ""
+}
+
+func postJSON(path string, body interface{}) *httptest.ResponseRecorder {
+	jsonValue, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", path, bytes.NewBuffer(jsonValue))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// testCSRFToken is sent as both CSRF cookie and header by the helpers.
+const testCSRFToken = "test-csrf-token"
+
+// withCSRF makes a cookie-authenticated request pass the CSRF check.
+func withCSRF(req *http.Request) {
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: testCSRFToken})
+	req.Header.Set(csrfHeaderName, testCSRFToken)
+}
+
+// serveWithToken performs a request authenticated with the token cookie.
+func serveWithToken(method, path string, body interface{}, token string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		jsonValue, _ := json.Marshal(body)
+		reader = bytes.NewBuffer(jsonValue)
+	}
+	req, _ := http.NewRequest(method, path, reader)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	withCSRF(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
 func TestRegistrationCreated(t *testing.T) {
 	registrationRequest := RegisterRequest{
 		Username:    "test-username",
 		Password:    "test-password",
+		Email:       "test-username@example.com",
 		Description: "test-description",
 	}
 	jsonValue, _ := json.Marshal(registrationRequest)
@@ -139,6 +227,71 @@ func TestRegistrationCreated(t *testing.T) {
 	assert.Equal(t, http.StatusCreated, w.Code)
 }
 
+func TestEmailVerificationFlow(t *testing.T) {
+	w := postJSON("/users/register", RegisterRequest{Username: "verify-me", Password: "verify-password", Email: "Verify-Me@example.com", Description: "d"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	w = postJSON("/users/login", LoginRequest{Username: "verify-me", Password: "verify-password"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	token := lastTokenMailedTo(t, "verify-me@example.com")
+	// a verification token is not an access token
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postJSON("/users/email/verify/confirm", TokenRequest{Token: token})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = postJSON("/users/email/verify/confirm", TokenRequest{Token: token})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postJSON("/users/login", LoginRequest{Username: "verify-me", Password: "verify-password"})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRegistrationDuplicateEmail(t *testing.T) {
+	w := postJSON("/users/register", RegisterRequest{Username: "dup-email-1", Password: "p", Email: "dup@example.com", Description: "d"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	w = postJSON("/users/register", RegisterRequest{Username: "dup-email-2", Password: "p", Email: "DUP@example.com", Description: "d"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPasswordResetFlow(t *testing.T) {
+	hashedPassword, _ := passwordHasher.Hash("old-password")
+	user := User{Name: "reset-me", Password: hashedPassword, Email: "reset-me@example.com", EmailVerified: true}
+	_, _ = db.Collection("users").InsertOne(context.TODO(), user)
+
+	// unknown addresses get the same answer
+	w := postJSON("/users/password/reset/request", EmailRequest{Email: "nobody@example.com"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	w = postJSON("/users/password/reset/request", EmailRequest{Email: "reset-me@example.com"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	token := lastTokenMailedTo(t, "reset-me@example.com")
+	w = postJSON("/users/email/verify/confirm", TokenRequest{Token: token})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = postJSON("/users/password/reset/confirm", PasswordResetRequest{Token: token, Password: "new-password"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = postJSON("/users/password/reset/confirm", PasswordResetRequest{Token: token, Password: "another-password"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postJSON("/users/login", LoginRequest{Username: "reset-me", Password: "old-password"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = postJSON("/users/login", LoginRequest{Username: "reset-me", Password: "new-password"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// a token sent before the account went to the trash no longer works
+	w = postJSON("/users/password/reset/request", EmailRequest{Email: "reset-me@example.com"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	token = lastTokenMailedTo(t, "reset-me@example.com")
+	_, err := db.Collection("users").UpdateOne(context.TODO(), bson.M{"name": "reset-me"}, bson.M{"$set": bson.M{"deleted_at": time.Now()}})
+	assert.NilError(t, err)
+	w = postJSON("/users/password/reset/confirm", PasswordResetRequest{Token: token, Password: "trashed-password"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestLoginSuccess(t *testing.T) {
 	loginRequest := LoginRequest{
 		Username: testUser["username"],
@@ -151,6 +304,1630 @@ func TestLoginSuccess(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
+func TestLoginUpgradesLegacyPasswordHash(t *testing.T) {
+	loginRequest := LoginRequest{
+		Username: testUser["username"],
+		Password: testUser["password"],
+	}
+	jsonValue, _ := json.Marshal(loginRequest)
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBuffer(jsonValue))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var user User
+	_ = db.Collection("users").FindOne(context.TODO(), bson.M{"name": testUser["username"]}).Decode(&user)
+	assert.Assert(t, strings.HasPrefix(user.Password, "$argon2id$"))
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	loginRequest := LoginRequest{
+		Username: testUser["username"],
+		Password: "not-the-password",
+	}
+	jsonValue, _ := json.Marshal(loginRequest)
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBuffer(jsonValue))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, 0, len(w.Result().Cookies()))
+}
+
+func loginFrom(ip, username, password string) *httptest.ResponseRecorder {
+	jsonValue, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBuffer(jsonValue))
+	req.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestLoginUnknownUserLooksLikeWrongPassword(t *testing.T) {
+	unknown := loginFrom("198.51.100.1", "no-such-user", "whatever")
+	wrong := loginFrom("198.51.100.1", testUser["username"], "whatever")
+	assert.Equal(t, http.StatusBadRequest, unknown.Code)
+	assert.Equal(t, wrong.Code, unknown.Code)
+	assert.Equal(t, wrong.Body.String(), unknown.Body.String())
+}
+
+func TestLoginLockoutAndUnlock(t *testing.T) {
+	saved := accountThrottle
+	accountThrottle = LoginThrottlePolicy{FreeAttempts: 1, Threshold: 3, BaseDelay: time.Minute, LockoutDuration: time.Hour}
+	defer func() { accountThrottle = saved }()
+
+	user, _ := createTestUser(t, "locked-out")
+	password := "password-" + user.Name
+
+	w := loginFrom("198.51.100.2", user.Name, "guess-1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = loginFrom("198.51.100.2", user.Name, "guess-2")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// backing off: even the right password is refused, from any address
+	w = loginFrom("198.51.100.3", user.Name, password)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Assert(t, w.Header().Get("Retry-After") != "")
+
+	var attempt LoginAttempt
+	_ = db.Collection("loginattempts").FindOne(context.TODO(), bson.M{"_id": accountThrottleKey(user.Name)}).Decode(&attempt)
+	assert.Equal(t, 2, attempt.Failures)
+
+	_, author := createTestUser(t, "lockout-author", RoleAuthor)
+	_, admin := createTestUser(t, "lockout-admin", RoleAdmin)
+	w = serveWithToken("DELETE", "/users/"+user.ID.Hex()+"/lockout", nil, author)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("DELETE", "/users/"+user.ID.Hex()+"/lockout", nil, admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = loginFrom("198.51.100.3", user.Name, password)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+// loginTestUser logs the mock user in and returns the cookies it was issued.
+func loginTestUser(t *testing.T) map[string]*http.Cookie {
+	loginRequest := LoginRequest{
+		Username: testUser["username"],
+		Password: testUser["password"],
+	}
+	jsonValue, _ := json.Marshal(loginRequest)
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBuffer(jsonValue))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	return responseCookies(w)
+}
+
+func responseCookies(w *httptest.ResponseRecorder) map[string]*http.Cookie {
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range w.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+	return cookies
+}
+
+func refreshWith(refreshToken string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/users/token/refresh", nil)
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: refreshToken})
+	withCSRF(req)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	cookies := loginTestUser(t)
+	first := cookies["refresh_token"].Value
+
+	w := refreshWith(first)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rotated := responseCookies(w)
+	second := rotated["refresh_token"].Value
+	assert.Assert(t, second != first)
+	assert.Assert(t, rotated["token"].Value != "")
+
+	w = refreshWith(second)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	cookies := loginTestUser(t)
+	first := cookies["refresh_token"].Value
+
+	w := refreshWith(first)
+	assert.Equal(t, http.StatusOK, w.Code)
+	second := responseCookies(w)["refresh_token"].Value
+
+	// replaying the consumed token kills the family, including its successor
+	w = refreshWith(first)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = refreshWith(second)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	cookies := loginTestUser(t)
+
+	logout := func(csrf bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/users/logout", nil)
+		req.AddCookie(cookies["token"])
+		req.AddCookie(cookies["refresh_token"])
+		if csrf {
+			withCSRF(req)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	// other sites cannot log the user out
+	w := logout(false)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = logout(true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	cleared := responseCookies(w)
+	assert.Equal(t, "", cleared["token"].Value)
+	assert.Assert(t, cleared["token"].MaxAge < 0)
+
+	w = refreshWith(cookies["refresh_token"].Value)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	// the access token dies with its session
+	w = serveWithToken("GET", "/users", nil, cookies["token"].Value)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestJWKS(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var set JWKSet
+	_ = json.Unmarshal(w.Body.Bytes(), &set)
+	assert.Equal(t, 1, len(set.Keys))
+	assert.Equal(t, keyRing.ActiveKey().ID, set.Keys[0].KeyID)
+	assert.Equal(t, "RSA", set.Keys[0].KeyType)
+}
+
+func TestReaderCannotInsertBlog(t *testing.T) {
+	_, token := createTestUser(t, "rbac-reader", RoleReader)
+	w := serveWithToken("POST", "/blog/insert", BlogRequest{Content: "not allowed"}, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestAuthorCannotDeleteOthersBlog(t *testing.T) {
+	_, token := createTestUser(t, "rbac-author", RoleAuthor)
+	w := serveWithToken("DELETE", fmt.Sprintf("/blog/%s", testUser["blogID"]), nil, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestAuthorCannotDeleteOtherUser(t *testing.T) {
+	_, token := createTestUser(t, "rbac-author-2", RoleAuthor)
+	w := serveWithToken("DELETE", fmt.Sprintf("/users/%s", testUser["ID"]), nil, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestEditorCanDeleteAnyBlog(t *testing.T) {
+	owner, _ := createTestUser(t, "rbac-blog-owner", RoleAuthor)
+	_, token := createTestUser(t, "rbac-editor", RoleEditor)
+	blogId := createTestBlog(t, owner.ID, "editor target")
+	w := serveWithToken("DELETE", fmt.Sprintf("/blog/%s", blogId.Hex()), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestSetUserRolesRequiresAdmin(t *testing.T) {
+	target, authorToken := createTestUser(t, "rbac-promoted", RoleAuthor)
+	_, adminToken := createTestUser(t, "rbac-admin", RoleAdmin)
+	path := fmt.Sprintf("/users/%s/roles", target.ID.Hex())
+
+	w := serveWithToken("PUT", path, RolesRequest{Roles: []Role{RoleAdmin}}, authorToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = serveWithToken("PUT", path, RolesRequest{Roles: []Role{"overlord"}}, adminToken)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serveWithToken("PUT", path, RolesRequest{Roles: []Role{RoleEditor}}, adminToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var user User
+	_ = db.Collection("users").FindOne(context.TODO(), bson.M{"_id": target.ID}).Decode(&user)
+	assert.DeepEqual(t, []Role{RoleEditor}, user.Roles)
+	// tokens issued with the old roles stop working
+	w = serveWithToken("GET", "/users/sessions", nil, authorToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestInsertCommentRecordsAuthor(t *testing.T) {
+	owner, _ := createTestUser(t, "owner-comment-author-blog", RoleAuthor)
+	commenter, token := createTestUser(t, "owner-commenter", RoleReader)
+	blogId := createTestBlog(t, owner.ID, "commented blog")
+
+	w := serveWithToken("POST", fmt.Sprintf("/comments/insert/%s", blogId.Hex()), CommentRequest{Comment: "hello"}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var comment Comment
+	_ = db.Collection("comments").FindOne(context.TODO(), bson.M{"blog_id": blogId}).Decode(&comment)
+	assert.Equal(t, commenter.ID, comment.AuthorID)
+	assert.Equal(t, "hello", comment.Text)
+	var blog Blog
+	_ = db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": blogId}).Decode(&blog)
+	assert.DeepEqual(t, []primitive.ObjectID{comment.ID}, blog.Comments)
+}
+
+func TestInsertCommentUnknownBlog(t *testing.T) {
+	_, token := createTestUser(t, "owner-lost-commenter", RoleReader)
+	w := serveWithToken("POST", fmt.Sprintf("/comments/insert/%s", primitive.NewObjectID().Hex()), CommentRequest{Comment: "hello"}, token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestCommentOwnership(t *testing.T) {
+	blogOwner, blogOwnerToken := createTestUser(t, "owner-blog", RoleAuthor)
+	author, authorToken := createTestUser(t, "owner-comment", RoleReader)
+	_, strangerToken := createTestUser(t, "owner-stranger", RoleAuthor)
+	blogId := createTestBlog(t, blogOwner.ID, "owned blog")
+	path := func(commentId primitive.ObjectID) string {
+		return fmt.Sprintf("/comments/delete/%s/%s", blogId.Hex(), commentId.Hex())
+	}
+
+	// neither the blog's nor the comment's owner
+	first := createTestComment(t, blogId, author.ID, "first")
+	w := serveWithToken("DELETE", path(first), nil, strangerToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// the comment's author
+	w = serveWithToken("DELETE", path(first), nil, authorToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the owner of the blog the comment sits on
+	second := createTestComment(t, blogId, author.ID, "second")
+	w = serveWithToken("DELETE", path(second), nil, blogOwnerToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCommentOwnershipAcrossBlogs(t *testing.T) {
+	victim, _ := createTestUser(t, "owner-victim", RoleAuthor)
+	attacker, attackerToken := createTestUser(t, "owner-attacker", RoleAuthor)
+	victimBlog := createTestBlog(t, victim.ID, "victim blog")
+	attackerBlog := createTestBlog(t, attacker.ID, "attacker blog")
+	commentId := createTestComment(t, victimBlog, victim.ID, "victim comment")
+
+	// owning a blog grants nothing over comments on another blog
+	path := fmt.Sprintf("/comments/delete/%s/%s", attackerBlog.Hex(), commentId.Hex())
+	w := serveWithToken("DELETE", path, nil, attackerToken)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var comment Comment
+	err := db.Collection("comments").FindOne(context.TODO(), bson.M{"_id": commentId}).Decode(&comment)
+	assert.NilError(t, err)
+}
+
+func TestBlogOwnerCanDeleteOwnBlog(t *testing.T) {
+	owner, token := createTestUser(t, "owner-deleting", RoleAuthor)
+	blogId := createTestBlog(t, owner.ID, "short lived")
+	w := serveWithToken("DELETE", fmt.Sprintf("/blog/%s", blogId.Hex()), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestBearerAuthentication(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer "+authTokenString)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req, _ = http.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	user, _ := createTestUser(t, "apikey-owner", RoleAuthor)
+	raw := apiKeyPrefix + "test-key"
+	_, err := db.Collection("apikeys").InsertOne(context.TODO(), APIKey{UserID: user.ID, Name: "ci", KeyHash: hashToken(raw), CreatedAt: time.Now()})
+	assert.NilError(t, err)
+
+	jsonValue, _ := json.Marshal(BlogRequest{Content: "published by ci"})
+	req, _ := http.NewRequest("POST", "/blog/insert", bytes.NewBuffer(jsonValue))
+	req.Header.Set("X-API-Key", raw)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the blog is recorded against the key's owner
+	count, _ := db.Collection("blogrecords").CountDocuments(context.TODO(), bson.M{"user_id": user.ID})
+	assert.Equal(t, int64(1), count)
+
+	req, _ = http.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-API-Key", apiKeyPrefix+"wrong-key")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPersonalAccessTokenScopes(t *testing.T) {
+	user, sessionToken := createTestUser(t, "pat-owner", RoleAuthor)
+	w := serveWithToken("POST", "/users/tokens", APIKeyRequest{Name: "ci", Scopes: []Permission{PermBlogsWrite}}, sessionToken)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct{ Token string }
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+	assert.Assert(t, strings.HasPrefix(created.Token, apiKeyPrefix))
+
+	serveWithKey := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		jsonValue, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonValue))
+		req.Header.Set("Authorization", "Bearer "+created.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = serveWithKey("POST", "/blog/insert", BlogRequest{Content: "from ci"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	// outside the token's scopes
+	w = serveWithKey("GET", "/users", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	// tokens cannot mint tokens
+	w = serveWithKey("POST", "/users/tokens", APIKeyRequest{Name: "more", Scopes: []Permission{PermBlogsWrite}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = serveWithToken("GET", "/users/tokens", nil, sessionToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var keys []APIKey
+	_ = json.Unmarshal(w.Body.Bytes(), &keys)
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, user.ID, keys[0].UserID)
+	assert.Assert(t, keys[0].LastUsedAt != nil)
+	assert.Assert(t, !strings.Contains(w.Body.String(), "KeyHash"))
+
+	w = serveWithToken("DELETE", fmt.Sprintf("/users/tokens/%s", keys[0].ID.Hex()), nil, sessionToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithKey("POST", "/blog/insert", BlogRequest{Content: "after revocation"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestPersonalAccessTokenExpiry(t *testing.T) {
+	user, sessionToken := createTestUser(t, "pat-expiring", RoleAuthor)
+	w := serveWithToken("POST", "/users/tokens", APIKeyRequest{Name: "past", Scopes: []Permission{PermBlogsRead}, ExpiresAt: &time.Time{}}, sessionToken)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	raw := apiKeyPrefix + "expired-key"
+	expired := time.Now().Add(-time.Minute)
+	_, _ = db.Collection("apikeys").InsertOne(context.TODO(), APIKey{UserID: user.ID, Name: "old", KeyHash: hashToken(raw), Scopes: []Permission{PermBlogsRead}, ExpiresAt: &expired})
+	req, _ := http.NewRequest("GET", "/blogs", nil)
+	req.Header.Set("X-API-Key", raw)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestMissingCredentials(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/users", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func totpCodeAt(t *testing.T, secret string, at time.Time) string {
+	key, err := totpEncoding.DecodeString(secret)
+	assert.NilError(t, err)
+	return totpCode(key, uint64(totpStep(at)))
+}
+
+func TestTOTPLoginFlow(t *testing.T) {
+	user, token := createTestUser(t, "mfa-user", RoleAuthor)
+
+	w := serveWithToken("POST", "/users/mfa/totp/enroll", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &enrollment)
+
+	w = serveWithToken("POST", "/users/mfa/totp/confirm", TOTPCodeRequest{Code: "000000x"}, token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	now := time.Now()
+	w = serveWithToken("POST", "/users/mfa/totp/confirm", TOTPCodeRequest{Code: totpCodeAt(t, enrollment.Secret, now)}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &confirmation)
+	assert.Equal(t, recoveryCodeCount, len(confirmation.RecoveryCodes))
+
+	login := func() string {
+		w := postJSON("/users/login", LoginRequest{Username: user.Name, Password: "password-" + user.Name})
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		assert.Assert(t, responseCookies(w)["token"] == nil)
+		var challenge struct {
+			Challenge string `json:"challenge"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &challenge)
+		return challenge.Challenge
+	}
+
+	challenge := login()
+	w = postJSON("/users/login/mfa", MFALoginRequest{Challenge: challenge, Code: "123456"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	// the code used to confirm enrollment cannot be replayed
+	w = postJSON("/users/login/mfa", MFALoginRequest{Challenge: challenge, Code: totpCodeAt(t, enrollment.Secret, now)})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	next := now.Add(totpPeriod * time.Second)
+	w = postJSON("/users/login/mfa", MFALoginRequest{Challenge: challenge, Code: totpCodeAt(t, enrollment.Secret, next)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Assert(t, responseCookies(w)["token"] != nil)
+
+	// recovery codes work exactly once
+	challenge = login()
+	w = postJSON("/users/login/mfa", MFALoginRequest{Challenge: challenge, RecoveryCode: confirmation.RecoveryCodes[0]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	challenge = login()
+	w = postJSON("/users/login/mfa", MFALoginRequest{Challenge: challenge, RecoveryCode: confirmation.RecoveryCodes[0]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func ssoLogin(t *testing.T, mock *mockOIDCProvider, claims jwt.MapClaims) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/users/oidc/login", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusFound, w.Code)
+	stateCookie := responseCookies(w)[oidcStateCookie]
+	assert.Assert(t, stateCookie != nil)
+
+	code, state := mock.authorize(t, w.Header().Get("Location"), claims)
+	query := url.Values{"code": {code}, "state": {state}}
+	req, _ = http.NewRequest("GET", "/users/oidc/callback?"+query.Encode(), nil)
+	req.AddCookie(stateCookie)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestOIDCLogin(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider, err := DiscoverOIDCProvider(context.Background(), mock.config())
+	assert.NilError(t, err)
+	oidcProvider = provider
+	defer func() { oidcProvider = nil }()
+
+	claims := jwt.MapClaims{"sub": "sso-1", "preferred_username": "sso-user", "email": "sso-user@example.com", "email_verified": true}
+	w := ssoLogin(t, mock, claims)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Assert(t, responseCookies(w)["token"] != nil)
+
+	// the second login finds the provisioned account again
+	w = ssoLogin(t, mock, claims)
+	assert.Equal(t, http.StatusOK, w.Code)
+	filter := bson.M{"oidc_issuer": mock.URL, "oidc_subject": "sso-1"}
+	count, _ := db.Collection("users").CountDocuments(context.TODO(), filter)
+	assert.Equal(t, int64(1), count)
+	var user User
+	_ = db.Collection("users").FindOne(context.TODO(), filter).Decode(&user)
+	assert.Equal(t, "sso-user", user.Name)
+	assert.Assert(t, user.EmailVerified)
+
+	// accounts created through sign-on cannot log in with a password
+	w = postJSON("/users/login", LoginRequest{Username: "sso-user", Password: ""})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOIDCLoginLinksVerifiedEmail(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider, err := DiscoverOIDCProvider(context.Background(), mock.config())
+	assert.NilError(t, err)
+	oidcProvider = provider
+	defer func() { oidcProvider = nil }()
+
+	verified := User{Name: "linked-local", Email: "linked@example.com", EmailVerified: true, Roles: []Role{RoleEditor}}
+	resp, _ := db.Collection("users").InsertOne(context.TODO(), verified)
+	unverified := User{Name: "squatter", Email: "squatted@example.com"}
+	_, _ = db.Collection("users").InsertOne(context.TODO(), unverified)
+
+	w := ssoLogin(t, mock, jwt.MapClaims{"sub": "sso-2", "email": "linked@example.com", "email_verified": true})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var user User
+	_ = db.Collection("users").FindOne(context.TODO(), bson.M{"_id": resp.InsertedID}).Decode(&user)
+	assert.Equal(t, "sso-2", user.OIDCSubject)
+
+	// an address nobody proved to own is never used to link
+	w = ssoLogin(t, mock, jwt.MapClaims{"sub": "sso-3", "email": "squatted@example.com", "email_verified": true})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = db.Collection("users").FindOne(context.TODO(), bson.M{"name": "squatter"}).Decode(&user)
+	assert.Equal(t, "", user.OIDCSubject)
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider, err := DiscoverOIDCProvider(context.Background(), mock.config())
+	assert.NilError(t, err)
+	oidcProvider = provider
+	defer func() { oidcProvider = nil }()
+
+	req, _ := http.NewRequest("GET", "/users/oidc/login", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	code, state := mock.authorize(t, w.Header().Get("Location"), jwt.MapClaims{"sub": "sso-4"})
+	query := url.Values{"code": {code}, "state": {state}}
+	req, _ = http.NewRequest("GET", "/users/oidc/callback?"+query.Encode(), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestUpdateProfile(t *testing.T) {
+	user, token := createTestUser(t, "profile-owner", RoleAuthor)
+	_, otherToken := createTestUser(t, "profile-other", RoleAuthor)
+
+	description := "writes about databases"
+	w := serveWithToken("PATCH", "/users/"+user.ID.Hex(), ProfileRequest{Description: &description}, otherToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("PATCH", "/users/"+user.ID.Hex(), ProfileRequest{}, token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serveWithToken("PATCH", "/users/"+user.ID.Hex(), ProfileRequest{Description: &description}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var updated User
+	_ = db.Collection("users").FindOne(context.TODO(), bson.M{"_id": user.ID}).Decode(&updated)
+	assert.Equal(t, description, updated.Description)
+	assert.Equal(t, user.Password, updated.Password)
+}
+
+func TestChangePasswordEndsOtherSessions(t *testing.T) {
+	user, token := createTestUser(t, "password-changer", RoleAuthor)
+	w := postJSON("/users/login", LoginRequest{Username: user.Name, Password: "password-" + user.Name})
+	assert.Equal(t, http.StatusOK, w.Code)
+	otherDevice := responseCookies(w)["refresh_token"].Value
+	w = serveWithToken("POST", "/users/tokens", APIKeyRequest{Name: "ci", Scopes: []Permission{PermBlogsRead}}, token)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct{ Token string }
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+
+	w = serveWithToken("PUT", "/users/"+user.ID.Hex()+"/password", PasswordChangeRequest{CurrentPassword: "wrong", NewPassword: "new-password"}, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("PUT", "/users/"+user.ID.Hex()+"/password", PasswordChangeRequest{CurrentPassword: "password-" + user.Name, NewPassword: "new-password"}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// the caller stays logged in on a new session
+	thisDevice := responseCookies(w)["refresh_token"]
+	assert.Assert(t, thisDevice != nil)
+
+	assert.Equal(t, http.StatusUnauthorized, refreshWith(otherDevice).Code)
+	assert.Equal(t, http.StatusOK, refreshWith(thisDevice.Value).Code)
+	// personal access tokens are revoked too
+	req, _ := http.NewRequest("GET", "/blogs", nil)
+	req.Header.Set("Authorization", "Bearer "+created.Token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postJSON("/users/login", LoginRequest{Username: user.Name, Password: "new-password"})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestChangeUsername(t *testing.T) {
+	user, token := createTestUser(t, "old-name", RoleAuthor)
+	createTestUser(t, "taken-name", RoleAuthor)
+	path := "/users/" + user.ID.Hex() + "/username"
+	password := "password-" + user.Name
+
+	w := serveWithToken("PUT", path, UsernameChangeRequest{Username: "new-name"}, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("PUT", path, UsernameChangeRequest{Username: "taken-name", CurrentPassword: password}, token)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	// names are unique even when two renames race past the check
+	_, err := db.Collection("users").InsertOne(context.TODO(), User{Name: "taken-name"})
+	assert.Assert(t, mongo.IsDuplicateKeyError(err))
+	w = serveWithToken("PUT", path, UsernameChangeRequest{Username: "new-name", CurrentPassword: password}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = postJSON("/users/login", LoginRequest{Username: "old-name", Password: password})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = postJSON("/users/login", LoginRequest{Username: "new-name", Password: password})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCurrentPasswordChecksAreThrottled(t *testing.T) {
+	saved := accountThrottle
+	accountThrottle = LoginThrottlePolicy{FreeAttempts: 1, Threshold: 3, BaseDelay: time.Minute, LockoutDuration: time.Hour}
+	defer func() { accountThrottle = saved }()
+
+	user, token := createTestUser(t, "password-guesser", RoleAuthor)
+	path := "/users/" + user.ID.Hex() + "/password"
+	password := "password-" + user.Name
+
+	w := serveWithToken("PUT", path, PasswordChangeRequest{CurrentPassword: "guess-1", NewPassword: "new-password"}, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("PUT", "/users/"+user.ID.Hex()+"/username", UsernameChangeRequest{Username: "guessed", CurrentPassword: "guess-2"}, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// a stolen access token cannot keep guessing, nor log in
+	w = serveWithToken("PUT", path, PasswordChangeRequest{CurrentPassword: password, NewPassword: "new-password"}, token)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	w = loginFrom("198.51.100.4", user.Name, password)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
+
+func TestCredentialsCannotChangeWithAccessToken(t *testing.T) {
+	user, token := createTestUser(t, "pat-holder", RoleAuthor)
+	w := serveWithToken("POST", "/users/tokens", APIKeyRequest{Name: "ci", Scopes: []Permission{PermUsersWrite}}, token)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct{ Token string }
+	_ = json.Unmarshal(w.Body.Bytes(), &created)
+
+	jsonValue, _ := json.Marshal(PasswordChangeRequest{CurrentPassword: "password-" + user.Name, NewPassword: "stolen"})
+	req, _ := http.NewRequest("PUT", "/users/"+user.ID.Hex()+"/password", bytes.NewBuffer(jsonValue))
+	req.Header.Set("Authorization", "Bearer "+created.Token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestUserResponsesHidePrivateFields(t *testing.T) {
+	user, token := createTestUser(t, "dto-owner", RoleAuthor)
+	_, otherToken := createTestUser(t, "dto-other", RoleAuthor)
+	_, adminToken := createTestUser(t, "dto-admin", RoleAdmin)
+
+	w := serveWithToken("GET", "/users", nil, otherToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Assert(t, !strings.Contains(w.Body.String(), user.Password))
+	assert.Assert(t, !strings.Contains(w.Body.String(), "Password"))
+
+	fields := map[string]interface{}{}
+	w = serveWithToken("GET", "/users/"+user.ID.Hex(), nil, otherToken)
+	_ = json.Unmarshal(w.Body.Bytes(), &fields)
+	assert.Assert(t, fields["Roles"] == nil)
+
+	fields = map[string]interface{}{}
+	w = serveWithToken("GET", "/users/"+user.ID.Hex(), nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &fields)
+	assert.Assert(t, fields["Roles"] != nil)
+	assert.Assert(t, fields["HasPassword"] == nil)
+
+	fields = map[string]interface{}{}
+	w = serveWithToken("GET", "/users/"+user.ID.Hex(), nil, adminToken)
+	_ = json.Unmarshal(w.Body.Bytes(), &fields)
+	assert.Equal(t, true, fields["HasPassword"])
+}
+
+func TestDeleteUserCascades(t *testing.T) {
+	user, _ := createTestUser(t, "cascade-user", RoleAuthor)
+	other, _ := createTestUser(t, "cascade-other", RoleAuthor)
+	_, admin := createTestUser(t, "cascade-admin", RoleAdmin)
+
+	ownBlog := createTestBlog(t, user.ID, "to be deleted")
+	createTestComment(t, ownBlog, other.ID, "on a doomed blog")
+	otherBlog := createTestBlog(t, other.ID, "survives")
+	ownComment := createTestComment(t, otherBlog, user.ID, "by the deleted user")
+	export := DataExport{ID: primitive.NewObjectID(), UserID: user.ID, Status: ExportReady, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(exportTTL)}
+	_, err := db.Collection("exports").InsertOne(context.TODO(), export)
+	assert.NilError(t, err)
+	assert.NilError(t, os.MkdirAll(exportDir, 0o700))
+	assert.NilError(t, os.WriteFile(exportPath(export.ID), []byte("zip"), 0o600))
+
+	w := serveWithToken("DELETE", "/trash/users/"+user.ID.Hex(), nil, admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serveWithToken("DELETE", "/users/"+user.ID.Hex(), nil, admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// the user is only trashed, but the reply tells what the purge will do
+	var trashed struct {
+		DeletedCount int64
+		PurgeAt      time.Time      `json:"purge_at"`
+		Policy       DeletionPolicy `json:"policy"`
+		Pending      DeletionReport `json:"pending"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &trashed)
+	assert.Equal(t, int64(1), trashed.DeletedCount)
+	assert.Assert(t, trashed.PurgeAt.After(time.Now()))
+	assert.Equal(t, BlogsDelete, trashed.Policy.Blogs)
+	assert.Equal(t, int64(1), trashed.Pending.Deleted["blogs"])
+	assert.Equal(t, int64(2), trashed.Pending.Deleted["comments"])
+
+	w = serveWithToken("DELETE", "/trash/users/"+user.ID.Hex(), nil, admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reply struct {
+		DeletedCount int64
+		Deleted      map[string]int64 `json:"deleted"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &reply)
+	assert.Equal(t, int64(1), reply.DeletedCount)
+	assert.Equal(t, int64(1), reply.Deleted["blogs"])
+	assert.Equal(t, int64(1), reply.Deleted["blogrecords"])
+	assert.Equal(t, int64(2), reply.Deleted["comments"])
+	assert.Equal(t, int64(1), reply.Deleted["exports"])
+	_, err = os.Stat(exportPath(export.ID))
+	assert.Assert(t, os.IsNotExist(err))
+
+	count, _ := db.Collection("blogs").CountDocuments(context.TODO(), bson.M{"_id": ownBlog})
+	assert.Equal(t, int64(0), count)
+	var blog Blog
+	_ = db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": otherBlog}).Decode(&blog)
+	assert.Assert(t, !containsID(blog.Comments, ownComment))
+}
+
+func TestDeleteUserTransfersAndAnonymizes(t *testing.T) {
+	saved := userDeletionPolicy
+	userDeletionPolicy = DeletionPolicy{Blogs: BlogsTransfer, Comments: CommentsAnonymize, TransferTo: "cascade-archive"}
+	defer func() { userDeletionPolicy = saved }()
+
+	user, token := createTestUser(t, "transfer-user", RoleAuthor)
+	archive, _ := createTestUser(t, "cascade-archive", RoleAuthor)
+	other, _ := createTestUser(t, "transfer-other", RoleAuthor)
+	_, admin := createTestUser(t, "transfer-admin", RoleAdmin)
+	ownBlog := createTestBlog(t, user.ID, "kept")
+	otherBlog := createTestBlog(t, other.ID, "also kept")
+	comment := createTestComment(t, otherBlog, user.ID, "kept without author")
+
+	w := serveWithToken("DELETE", "/users/"+user.ID.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("DELETE", "/trash/users/"+user.ID.Hex(), nil, admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reply struct {
+		Transferred map[string]int64 `json:"transferred"`
+		Anonymized  map[string]int64 `json:"anonymized"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &reply)
+	assert.Equal(t, int64(1), reply.Transferred["blogrecords"])
+	assert.Equal(t, int64(1), reply.Anonymized["comments"])
+
+	var record BlogRecord
+	_ = db.Collection("blogrecords").FindOne(context.TODO(), bson.M{"blog_id": ownBlog}).Decode(&record)
+	assert.Equal(t, archive.ID, record.UserID)
+	var kept Comment
+	_ = db.Collection("comments").FindOne(context.TODO(), bson.M{"_id": comment}).Decode(&kept)
+	assert.Equal(t, "kept without author", kept.Text)
+	assert.Assert(t, kept.AuthorID.IsZero())
+}
+
+func TestTrashAndRestoreBlog(t *testing.T) {
+	owner, token := createTestUser(t, "trash-owner", RoleAuthor)
+	other, otherToken := createTestUser(t, "trash-other", RoleAuthor)
+	blogID := createTestBlog(t, owner.ID, "trash me")
+	kept := createTestComment(t, blogID, other.ID, "comes back")
+	gone := createTestComment(t, blogID, other.ID, "deleted on its own")
+
+	w := serveWithToken("DELETE", "/comments/delete/"+blogID.Hex()+"/"+gone.Hex(), nil, otherToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("DELETE", "/blog/"+blogID.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	count, _ := db.Collection("blogs").CountDocuments(context.TODO(), bson.M{"_id": blogID, "deleted_at": notDeleted})
+	assert.Equal(t, int64(0), count)
+	w = serveWithToken("POST", "/comments/insert/"+blogID.Hex(), CommentRequest{Comment: "too late"}, otherToken)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var trashed []BlogResponse
+	w = serveWithToken("GET", "/trash/blogs", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &trashed)
+	assert.Equal(t, 1, len(trashed))
+	assert.Equal(t, blogID, trashed[0].ID)
+	assert.Assert(t, trashed[0].DeletedAt != nil)
+
+	w = serveWithToken("POST", "/trash/blogs/"+blogID.Hex()+"/restore", nil, otherToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("POST", "/trash/blogs/"+blogID.Hex()+"/restore", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("POST", "/trash/blogs/"+blogID.Hex()+"/restore", nil, token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	count, _ = db.Collection("comments").CountDocuments(context.TODO(), bson.M{"_id": kept, "deleted_at": notDeleted})
+	assert.Equal(t, int64(1), count)
+	count, _ = db.Collection("comments").CountDocuments(context.TODO(), bson.M{"_id": gone, "deleted_at": notDeleted})
+	assert.Equal(t, int64(0), count)
+}
+
+func TestTrashAndRestoreComment(t *testing.T) {
+	owner, token := createTestUser(t, "trash-comment-owner", RoleAuthor)
+	author, authorToken := createTestUser(t, "trash-comment-author", RoleAuthor)
+	_, strangerToken := createTestUser(t, "trash-comment-stranger", RoleAuthor)
+	blogID := createTestBlog(t, owner.ID, "with a comment")
+	commentID := createTestComment(t, blogID, author.ID, "oops")
+
+	w := serveWithToken("DELETE", "/comments/delete/"+blogID.Hex()+"/"+commentID.Hex(), nil, authorToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var trashed []CommentResponse
+	w = serveWithToken("GET", "/trash/comments", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &trashed)
+	assert.Equal(t, 1, len(trashed))
+	trashed = nil
+	w = serveWithToken("GET", "/trash/comments", nil, strangerToken)
+	_ = json.Unmarshal(w.Body.Bytes(), &trashed)
+	assert.Equal(t, 0, len(trashed))
+
+	w = serveWithToken("POST", "/trash/comments/"+commentID.Hex()+"/restore", nil, strangerToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("POST", "/trash/comments/"+commentID.Hex()+"/restore", nil, authorToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var blog Blog
+	_ = db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": blogID}).Decode(&blog)
+	assert.Assert(t, containsID(blog.Comments, commentID))
+
+	w = serveWithToken("DELETE", "/comments/delete/"+blogID.Hex()+"/"+commentID.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("DELETE", "/trash/comments/"+commentID.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	count, _ := db.Collection("comments").CountDocuments(context.TODO(), bson.M{"_id": commentID})
+	assert.Equal(t, int64(0), count)
+}
+
+func TestTrashAndRestoreUser(t *testing.T) {
+	user, token := createTestUser(t, "trash-user", RoleAuthor)
+	_, admin := createTestUser(t, "trash-admin", RoleAdmin)
+
+	w := serveWithToken("DELETE", "/users/"+user.ID.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = loginFrom("10.0.15.1", "trash-user", "password-trash-user")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serveWithToken("GET", "/users/"+user.ID.Hex(), nil, admin)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// deleting the account ended its sessions
+	w = serveWithToken("GET", "/trash/users", nil, token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = serveWithToken("POST", "/trash/users/"+user.ID.Hex()+"/restore", nil, admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = loginFrom("10.0.15.1", "trash-user", "password-trash-user")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	owner, token := createTestUser(t, "purge-owner", RoleAuthor)
+	blogID := createTestBlog(t, owner.ID, "purge me")
+	commentID := createTestComment(t, blogID, owner.ID, "purged along")
+
+	w := serveWithToken("DELETE", "/blog/"+blogID.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	report, err := purgeTrash(context.TODO(), time.Now().Add(-time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, int64(0), report.Deleted["blogs"])
+
+	report, err = purgeTrash(context.TODO(), time.Now().Add(time.Minute))
+	assert.NilError(t, err)
+	assert.Assert(t, report.Deleted["blogs"] >= 1)
+	count, _ := db.Collection("comments").CountDocuments(context.TODO(), bson.M{"_id": commentID})
+	assert.Equal(t, int64(0), count)
+	count, _ = db.Collection("blogrecords").CountDocuments(context.TODO(), bson.M{"blog_id": blogID})
+	assert.Equal(t, int64(0), count)
+}
+
+func TestPurgeTrashSkipsFailures(t *testing.T) {
+	saved := userDeletionPolicy
+	userDeletionPolicy = DeletionPolicy{Blogs: BlogsTransfer, Comments: CommentsDelete, TransferTo: "no-such-heir"}
+	defer func() { userDeletionPolicy = saved }()
+
+	stuck, stuckToken := createTestUser(t, "purge-stuck", RoleAuthor)
+	owner, ownerToken := createTestUser(t, "purge-blog-owner", RoleAuthor)
+	blogID := createTestBlog(t, owner.ID, "purged despite the stuck user")
+	w := serveWithToken("DELETE", "/users/"+stuck.ID.Hex(), nil, stuckToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("DELETE", "/blog/"+blogID.Hex(), nil, ownerToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	report, err := purgeTrash(context.TODO(), time.Now().Add(time.Minute))
+	assert.Assert(t, errors.Is(err, ErrTransferTarget))
+	assert.Assert(t, report.Deleted["blogs"] >= 1)
+	count, _ := db.Collection("blogs").CountDocuments(context.TODO(), bson.M{"_id": blogID})
+	assert.Equal(t, int64(0), count)
+	// the user stays in the trash until the policy is fixed
+	count, _ = db.Collection("users").CountDocuments(context.TODO(), bson.M{"_id": stuck.ID})
+	assert.Equal(t, int64(1), count)
+}
+
+func TestFollowAndFeed(t *testing.T) {
+	reader, token := createTestUser(t, "feed-reader", RoleReader)
+	author, _ := createTestUser(t, "feed-author", RoleAuthor)
+	stranger, _ := createTestUser(t, "feed-stranger", RoleAuthor)
+	first := createTestBlog(t, author.ID, "first post")
+	second := createTestBlog(t, author.ID, "second post")
+	createTestBlog(t, stranger.ID, "not followed")
+
+	w := serveWithToken("POST", "/users/"+reader.ID.Hex()+"/follow", nil, token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serveWithToken("POST", "/users/"+author.ID.Hex()+"/follow", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("POST", "/users/"+author.ID.Hex()+"/follow", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var profile struct{ Followers, Following int64 }
+	w = serveWithToken("GET", "/users/"+author.ID.Hex(), nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &profile)
+	assert.Equal(t, int64(1), profile.Followers)
+	var followers struct {
+		Count int64        `json:"count"`
+		Users []PublicUser `json:"users"`
+	}
+	w = serveWithToken("GET", "/users/"+author.ID.Hex()+"/followers", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &followers)
+	assert.Equal(t, int64(1), followers.Count)
+	assert.Equal(t, reader.ID, followers.Users[0].ID)
+
+	type feedPage struct {
+		Blogs      []FeedEntry `json:"blogs"`
+		NextCursor string      `json:"next_cursor"`
+	}
+	var page feedPage
+	w = serveWithToken("GET", "/feed?limit=1", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, 1, len(page.Blogs))
+	assert.Equal(t, second, page.Blogs[0].ID)
+	assert.Equal(t, "feed-author", page.Blogs[0].Author.Name)
+	assert.Assert(t, page.NextCursor != "")
+
+	next := page.NextCursor
+	page = feedPage{}
+	w = serveWithToken("GET", "/feed?limit=1&cursor="+next, nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, 1, len(page.Blogs))
+	assert.Equal(t, first, page.Blogs[0].ID)
+	assert.Equal(t, "", page.NextCursor)
+
+	w = serveWithToken("DELETE", "/users/"+author.ID.Hex()+"/follow", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	page = feedPage{}
+	w = serveWithToken("GET", "/feed", nil, token)
+	_ = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, 0, len(page.Blogs))
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	user, _ := createTestUser(t, "session-owner", RoleAuthor)
+	login := func(userAgent string) map[string]*http.Cookie {
+		jsonValue, _ := json.Marshal(LoginRequest{Username: user.Name, Password: "password-" + user.Name})
+		req, _ := http.NewRequest("POST", "/users/login", bytes.NewBuffer(jsonValue))
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = "10.0.17.1:40000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		return responseCookies(w)
+	}
+	laptop := login("laptop-browser")
+	phone := login("phone-app")
+	tablet := login("tablet-app")
+
+	var sessions []SessionResponse
+	w := serveWithToken("GET", "/users/sessions", nil, laptop["token"].Value)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &sessions)
+	// createTestUser opened one more
+	assert.Equal(t, 4, len(sessions))
+	var phoneSession SessionResponse
+	for _, session := range sessions {
+		if session.UserAgent == "phone-app" {
+			phoneSession = session
+		}
+		assert.Equal(t, session.UserAgent == "laptop-browser", session.Current)
+	}
+	assert.Equal(t, "10.0.17.1", phoneSession.IP)
+
+	w = serveWithToken("DELETE", "/users/sessions/"+phoneSession.ID.Hex(), nil, laptop["token"].Value)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("GET", "/users/sessions", nil, phone["token"].Value)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshWith(phone["refresh_token"].Value).Code)
+	w = serveWithToken("DELETE", "/users/sessions/"+phoneSession.ID.Hex(), nil, laptop["token"].Value)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = serveWithToken("DELETE", "/users/sessions", nil, laptop["token"].Value)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("GET", "/users/sessions", nil, tablet["token"].Value)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	sessions = nil
+	w = serveWithToken("GET", "/users/sessions", nil, laptop["token"].Value)
+	_ = json.Unmarshal(w.Body.Bytes(), &sessions)
+	assert.Equal(t, 1, len(sessions))
+	assert.Assert(t, sessions[0].Current)
+}
+
+func TestLoginCookieAttributes(t *testing.T) {
+	cookies := loginTestUser(t)
+	assert.Assert(t, cookies["token"].HttpOnly)
+	assert.Assert(t, cookies["refresh_token"].HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookies["token"].SameSite)
+	// scripts must be able to read the CSRF token to echo it
+	assert.Assert(t, cookies[csrfCookieName].Value != "")
+	assert.Assert(t, !cookies[csrfCookieName].HttpOnly)
+}
+
+func TestCSRFRequiredForCookieMutations(t *testing.T) {
+	_, token := createTestUser(t, "csrf-author", RoleAuthor)
+	insert := func(setCSRF func(req *http.Request)) int {
+		jsonValue, _ := json.Marshal(BlogRequest{Content: "csrf"})
+		req, _ := http.NewRequest("POST", "/blog/insert", bytes.NewBuffer(jsonValue))
+		req.AddCookie(&http.Cookie{Name: "token", Value: token})
+		setCSRF(req)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusForbidden, insert(func(req *http.Request) {}))
+	assert.Equal(t, http.StatusForbidden, insert(func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "one"})
+		req.Header.Set(csrfHeaderName, "another")
+	}))
+	assert.Equal(t, http.StatusOK, insert(withCSRF))
+
+	// reads need no token, and bearer tokens are not sent by browsers
+	req, _ := http.NewRequest("GET", "/blogs", nil)
+	req.AddCookie(&http.Cookie{Name: "token", Value: token})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	jsonValue, _ := json.Marshal(BlogRequest{Content: "bearer"})
+	req, _ = http.NewRequest("POST", "/blog/insert", bytes.NewBuffer(jsonValue))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLoginReplacesPlantedCSRFToken(t *testing.T) {
+	jsonValue, _ := json.Marshal(LoginRequest{Username: testUser["username"], Password: testUser["password"]})
+	req, _ := http.NewRequest("POST", "/users/login", bytes.NewBuffer(jsonValue))
+	req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "planted"})
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	cookies := responseCookies(w)
+	assert.Assert(t, cookies[csrfCookieName].Value != "planted")
+
+	// a refresh keeps the session's token
+	w = refreshWith(cookies["refresh_token"].Value)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, testCSRFToken, responseCookies(w)[csrfCookieName].Value)
+}
+
+func TestRefreshWithCookieRequiresCSRF(t *testing.T) {
+	cookies := loginTestUser(t)
+	req, _ := http.NewRequest("POST", "/users/token/refresh", nil)
+	req.AddCookie(cookies["refresh_token"])
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// the token was not consumed
+	assert.Equal(t, http.StatusOK, refreshWith(cookies["refresh_token"].Value).Code)
+}
+
+func TestAuditLog(t *testing.T) {
+	user, token := createTestUser(t, "audited-user", RoleAuthor)
+	_, admin := createTestUser(t, "auditor", RoleAdmin)
+
+	w := loginFrom("10.0.19.1", user.Name, "wrong")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = loginFrom("10.0.19.1", user.Name, "password-"+user.Name)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("PUT", "/users/"+user.ID.Hex()+"/roles", RolesRequest{Roles: []Role{RoleAdmin}}, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	type eventPage struct {
+		Events     []AuditEvent `json:"events"`
+		NextCursor string       `json:"next_cursor"`
+	}
+	var page eventPage
+	w = serveWithToken("GET", "/audit?actor="+user.Name, nil, admin)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, 3, len(page.Events))
+	assert.Equal(t, AuditPermissionDenied, page.Events[0].Action)
+	assert.Equal(t, AuditLogin, page.Events[1].Action)
+	assert.Equal(t, AuditLoginFailed, page.Events[2].Action)
+	assert.Equal(t, "10.0.19.1", page.Events[2].IP)
+
+	page = eventPage{}
+	from := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	w = serveWithToken("GET", "/audit?action=login_failed&limit=1&from="+from+"&actor="+user.ID.Hex(), nil, admin)
+	_ = json.Unmarshal(w.Body.Bytes(), &page)
+	assert.Equal(t, 1, len(page.Events))
+	assert.Equal(t, "wrong password", page.Events[0].Details["reason"])
+
+	w = serveWithToken("GET", "/audit", nil, token)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	var verified struct {
+		Valid  bool  `json:"valid"`
+		Events int64 `json:"events"`
+	}
+	w = serveWithToken("GET", "/audit/verify", nil, admin)
+	_ = json.Unmarshal(w.Body.Bytes(), &verified)
+	assert.Assert(t, verified.Valid)
+	assert.Assert(t, verified.Events >= 3)
+
+	// editing an event breaks the chain
+	failed := page.Events[0]
+	_, err := db.Collection("auditevents").UpdateByID(context.TODO(), failed.ID, bson.M{"$set": bson.M{"ip": "10.9.9.9"}})
+	assert.NilError(t, err)
+	defer db.Collection("auditevents").UpdateByID(context.TODO(), failed.ID, bson.M{"$set": bson.M{"ip": failed.IP}})
+	_, err = verifyAuditChain(context.TODO())
+	assert.Assert(t, errors.Is(err, ErrAuditChainBroken))
+}
+
+// zipContents returns the files of a zip archive by name.
+func zipContents(t *testing.T, data []byte) map[string][]byte {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.NilError(t, err)
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		assert.NilError(t, err)
+		files[f.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+	return files
+}
+
+func TestExportUserData(t *testing.T) {
+	user, token := createTestUser(t, "export-owner", RoleAuthor)
+	blogId := createTestBlog(t, user.ID, "my exported post")
+	createTestComment(t, blogId, user.ID, "my exported comment")
+	_, otherToken := createTestUser(t, "export-other", RoleAuthor)
+
+	w := serveWithToken("GET", "/users/"+user.ID.Hex()+"/export", nil, otherToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = serveWithToken("GET", "/users/"+user.ID.Hex()+"/export", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	files := zipContents(t, w.Body.Bytes())
+	for _, name := range []string{"profile.json", "blogs.json", "comments.json", "sessions.json", "posts/" + blogId.Hex() + ".md"} {
+		_, ok := files[name]
+		assert.Assert(t, ok, name)
+	}
+	var profile PublicUser
+	assert.NilError(t, json.Unmarshal(files["profile.json"], &profile))
+	assert.Equal(t, user.Name, profile.Name)
+	var comments []CommentResponse
+	assert.NilError(t, json.Unmarshal(files["comments.json"], &comments))
+	assert.Equal(t, 1, len(comments))
+	assert.Assert(t, strings.Contains(string(files["posts/"+blogId.Hex()+".md"]), "my exported post"))
+
+	// exports too large to download are created and built in the background
+	saved := exportSyncLimit
+	exportSyncLimit = 1
+	w = serveWithToken("GET", "/users/"+user.ID.Hex()+"/export", nil, token)
+	exportSyncLimit = saved
+	assert.Equal(t, http.StatusConflict, w.Code)
+	exported := func() int64 {
+		count, _ := db.Collection("auditevents").CountDocuments(context.TODO(), bson.M{"action": AuditDataExported, "target_id": user.ID})
+		return count
+	}
+	// only the download that went through is audited
+	assert.Equal(t, int64(1), exported())
+	w = serveWithToken("POST", "/users/"+user.ID.Hex()+"/export", nil, otherToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("POST", "/users/"+user.ID.Hex()+"/export", nil, token)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var export ExportResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &export)
+	assert.Equal(t, ExportPending, export.Status)
+	location := w.Header().Get("Location")
+	assert.Equal(t, "/users/"+user.ID.Hex()+"/exports/"+export.ID.Hex(), location)
+
+	for i := 0; i < 50 && export.Status == ExportPending; i++ {
+		time.Sleep(20 * time.Millisecond)
+		w = serveWithToken("GET", location, nil, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		_ = json.Unmarshal(w.Body.Bytes(), &export)
+	}
+	assert.Equal(t, ExportReady, export.Status)
+	assert.Equal(t, location+"/download", export.DownloadURL)
+	assert.Equal(t, int64(2), exported())
+
+	w = serveWithToken("GET", export.DownloadURL, nil, otherToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("GET", export.DownloadURL, nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(w.Body.Len()), export.Size)
+	_, ok := zipContents(t, w.Body.Bytes())["profile.json"]
+	assert.Assert(t, ok)
+
+	// an export left pending by a restart is handed out again rather than
+	// built twice, and built when the server starts
+	interrupted := DataExport{ID: primitive.NewObjectID(), UserID: user.ID, Status: ExportPending, CreatedAt: time.Now(), ExpiresAt: time.Now().Add(exportTTL)}
+	_, err := db.Collection("exports").InsertOne(context.TODO(), interrupted)
+	assert.NilError(t, err)
+	w = serveWithToken("POST", "/users/"+user.ID.Hex()+"/export", nil, token)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var again ExportResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &again)
+	assert.Equal(t, interrupted.ID, again.ID)
+	assert.NilError(t, resumePendingExports(context.TODO(), time.Now()))
+	_ = db.Collection("exports").FindOne(context.TODO(), bson.M{"_id": interrupted.ID}).Decode(&interrupted)
+	assert.Equal(t, ExportReady, interrupted.Status)
+
+	assert.NilError(t, removeExpiredExports(context.TODO(), time.Now().Add(exportTTL+time.Minute)))
+	w = serveWithToken("GET", location, nil, token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	_, err = os.Stat(exportPath(export.ID))
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestBlogTitleSlugAndAuthor(t *testing.T) {
+	user, token := createTestUser(t, "slug-author", RoleAuthor)
+	insert := func(req BlogRequest) map[string]string {
+		w := serveWithToken("POST", "/blog/insert", req, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var reply map[string]string
+		_ = json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply
+	}
+	first := insert(BlogRequest{Title: "Hello, Slugs!", Content: "first post body"})
+	assert.Equal(t, "hello-slugs", first["Slug"])
+	second := insert(BlogRequest{Title: "hello slugs", Summary: "custom summary", Content: "second"})
+	assert.Equal(t, "hello-slugs-2", second["Slug"])
+
+	var blog BlogDetail
+	w := serveWithToken("GET", "/blogs/slug/hello-slugs", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &blog)
+	assert.Equal(t, first["ID"], blog.ID.Hex())
+	assert.Equal(t, "Hello, Slugs!", blog.Title)
+	assert.Equal(t, "first post body", blog.Summary)
+	assert.Equal(t, user.ID, blog.AuthorID)
+	assert.Equal(t, user.Name, blog.Author.Name)
+	assert.Assert(t, !blog.UpdatedAt.IsZero())
+
+	w = serveWithToken("GET", "/blogs/"+second["ID"], nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &blog)
+	assert.Equal(t, "custom summary", blog.Summary)
+
+	// blogs stored before authors were recorded find theirs by blog record
+	legacyId := createTestBlog(t, user.ID, "legacy")
+	w = serveWithToken("GET", "/blogs/"+legacyId.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &blog)
+	assert.Equal(t, user.ID, blog.AuthorID)
+	assert.Equal(t, user.Name, blog.Author.Name)
+
+	w = serveWithToken("DELETE", "/blog/"+first["ID"], nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serveWithToken("GET", "/blogs/slug/hello-slugs", nil, token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = serveWithToken("GET", "/blogs/not-an-id", nil, token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// the blogs of an author in the trash are hidden with them
+	_, reader := createTestUser(t, "slug-reader", RoleReader)
+	_, err := db.Collection("users").UpdateByID(context.TODO(), user.ID, bson.M{"$set": bson.M{"deleted_at": time.Now()}})
+	assert.NilError(t, err)
+	w = serveWithToken("GET", "/blogs/"+second["ID"], nil, reader)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGetAllBlogsModes(t *testing.T) {
+	alice, aliceToken := createTestUser(t, "listing-alice", RoleAuthor)
+	bob, bobToken := createTestUser(t, "listing-bob", RoleAuthor)
+	for _, content := range []string{"alice one", "alice two"} {
+		w := serveWithToken("POST", "/blog/insert", BlogRequest{Title: content, Content: content}, aliceToken)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w := serveWithToken("POST", "/blog/insert", BlogRequest{Content: "bob only"}, bobToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	type page struct {
+		Blogs      []FeedEntry `json:"blogs"`
+		NextCursor string      `json:"next_cursor"`
+	}
+	list := func(query, token string) page {
+		w := serveWithToken("GET", "/blogs"+query, nil, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var p page
+		_ = json.Unmarshal(w.Body.Bytes(), &p)
+		return p
+	}
+	contents := func(p page) []string {
+		var result []string
+		for _, blog := range p.Blogs {
+			result = append(result, blog.Content)
+		}
+		return result
+	}
+
+	mine := list("", aliceToken)
+	assert.DeepEqual(t, []string{"alice two", "alice one"}, contents(mine))
+	assert.Equal(t, "alice two", mine.Blogs[0].Title)
+	assert.Equal(t, alice.Name, mine.Blogs[0].Author.Name)
+	assert.Equal(t, alice.ID, mine.Blogs[0].AuthorID)
+
+	byBob := list("?author="+bob.ID.Hex(), aliceToken)
+	assert.DeepEqual(t, []string{"bob only"}, contents(byBob))
+	assert.Equal(t, bob.Name, byBob.Blogs[0].Author.Name)
+
+	first := list("?author="+alice.ID.Hex()+"&limit=1", bobToken)
+	assert.DeepEqual(t, []string{"alice two"}, contents(first))
+	second := list("?author="+alice.ID.Hex()+"&limit=1&cursor="+first.NextCursor, bobToken)
+	assert.DeepEqual(t, []string{"alice one"}, contents(second))
+	assert.Equal(t, "", second.NextCursor)
+
+	everyone := list("?all=true&limit=100", bobToken)
+	found := map[string]bool{}
+	for _, content := range contents(everyone) {
+		found[content] = true
+	}
+	assert.Assert(t, found["alice one"] && found["alice two"] && found["bob only"])
+
+	// trashed blogs drop out of every mode
+	w = serveWithToken("DELETE", "/blog/"+byBob.Blogs[0].ID.Hex(), nil, bobToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, len(list("", bobToken).Blogs))
+	for _, content := range contents(list("?all=true&limit=100", bobToken)) {
+		assert.Assert(t, content != "bob only")
+	}
+
+	w = serveWithToken("GET", "/blogs?author=nobody", nil, aliceToken)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestBlogRevisions(t *testing.T) {
+	user, token := createTestUser(t, "revision-author", RoleAuthor)
+	_, otherToken := createTestUser(t, "revision-other", RoleAuthor)
+	_, editorToken := createTestUser(t, "revision-editor", RoleEditor)
+	w := serveWithToken("POST", "/blog/insert", BlogRequest{Title: "Draft title", Content: "first line\nsecond line\n"}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var inserted map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &inserted)
+	base := "/blog/" + inserted["ID"]
+
+	w = serveWithToken("PUT", base, BlogUpdateRequest{Title: "Stolen", Content: "mine now"}, otherToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	var blog BlogResponse
+	w = serveWithToken("PUT", base, BlogUpdateRequest{Title: "Final title", Content: "first line\nsecond line, edited\n", Revision: 1}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &blog)
+	assert.Equal(t, 2, blog.Revision)
+	assert.Equal(t, "Final title", blog.Title)
+	assert.Equal(t, "draft-title", blog.Slug)
+	// an edit based on a stale revision is refused
+	w = serveWithToken("PUT", base, BlogUpdateRequest{Content: "stale", Revision: 1}, token)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = serveWithToken("PUT", base, BlogUpdateRequest{Title: "Final title", Content: "rewritten by an editor\n"}, editorToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var revisions []RevisionSummary
+	w = serveWithToken("GET", base+"/revisions", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &revisions)
+	assert.Equal(t, 3, len(revisions))
+	assert.Equal(t, 3, revisions[0].Number)
+	assert.Assert(t, revisions[0].Current)
+	assert.Equal(t, "Draft title", revisions[2].Title)
+	assert.Equal(t, user.ID, revisions[2].EditedBy)
+	w = serveWithToken("GET", base+"/revisions", nil, otherToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	var revision RevisionResponse
+	w = serveWithToken("GET", base+"/revisions/1", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &revision)
+	assert.Equal(t, "first line\nsecond line\n", revision.Content)
+	w = serveWithToken("GET", base+"/revisions/9", nil, token)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var diff struct {
+		Changes []DiffOp `json:"changes"`
+	}
+	w = serveWithToken("GET", base+"/diff?from=1&to=2", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &diff)
+	assert.DeepEqual(t, []DiffOp{
+		{Op: DiffEqual, Text: "first line\n"},
+		{Op: DiffDelete, Text: "second line\n"},
+		{Op: DiffInsert, Text: "second line, edited\n"},
+	}, diff.Changes)
+	w = serveWithToken("GET", base+"/diff?from=1&to=2&mode=word", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &diff)
+	assert.DeepEqual(t, []DiffOp{
+		{Op: DiffEqual, Text: "first line\nsecond "},
+		{Op: DiffDelete, Text: "line"},
+		{Op: DiffInsert, Text: "line, edited"},
+		{Op: DiffEqual, Text: "\n"},
+	}, diff.Changes)
+	w = serveWithToken("GET", base+"/diff?mode=char", nil, token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serveWithToken("POST", base+"/revisions/1/restore", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &blog)
+	assert.Equal(t, 4, blog.Revision)
+	assert.Equal(t, "Draft title", blog.Title)
+	assert.Equal(t, "first line\nsecond line\n", blog.Content)
+	w = serveWithToken("GET", base+"/revisions/3", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &revision)
+	assert.Equal(t, "rewritten by an editor\n", revision.Content)
+}
+
+func TestPagingThroughDrafts(t *testing.T) {
+	_, token := createTestUser(t, "paging-drafter", RoleAuthor)
+	want := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("draft %d", i)
+		w := serveWithToken("POST", "/blog/insert", BlogRequest{Content: content, Status: BlogDraft}, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		want[content] = true
+	}
+	w := serveWithToken("POST", "/blog/insert", BlogRequest{Content: "published"}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	want["published"] = true
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		w := serveWithToken("GET", "/blogs?limit=2&cursor="+cursor, nil, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var page struct {
+			Blogs      []FeedEntry `json:"blogs"`
+			NextCursor string      `json:"next_cursor"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &page)
+		for _, blog := range page.Blogs {
+			assert.Assert(t, !seen[blog.Content], "listed twice: %s", blog.Content)
+			seen[blog.Content] = true
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, "", cursor)
+	assert.DeepEqual(t, want, seen)
+}
+
+func TestDraftsAndScheduledPublishing(t *testing.T) {
+	author, token := createTestUser(t, "publishing-author", RoleAuthor)
+	_, readerToken := createTestUser(t, "publishing-reader", RoleReader)
+	_, editorToken := createTestUser(t, "publishing-editor", RoleEditor)
+	insert := func(req BlogRequest) string {
+		w := serveWithToken("POST", "/blog/insert", req, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var reply map[string]string
+		_ = json.Unmarshal(w.Body.Bytes(), &reply)
+		return reply["ID"]
+	}
+	listContents := func(query, token string) map[string]bool {
+		w := serveWithToken("GET", "/blogs"+query, nil, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var page struct {
+			Blogs []FeedEntry `json:"blogs"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &page)
+		contents := map[string]bool{}
+		for _, blog := range page.Blogs {
+			contents[blog.Content] = true
+		}
+		return contents
+	}
+
+	draftId := insert(BlogRequest{Content: "a draft", Status: BlogDraft})
+	publishAt := time.Now().Add(time.Hour)
+	scheduledId := insert(BlogRequest{Content: "a scheduled post", PublishAt: &publishAt})
+	insert(BlogRequest{Content: "a published post"})
+	w := serveWithToken("POST", "/blog/insert", BlogRequest{Content: "too late", Status: BlogScheduled, PublishAt: &time.Time{}}, token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serveWithToken("POST", "/blog/insert", BlogRequest{Content: "bad", Status: "secret"}, token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	own := listContents("", token)
+	assert.Assert(t, own["a draft"] && own["a scheduled post"] && own["a published post"])
+	byAuthor := listContents("?author="+author.ID.Hex(), readerToken)
+	assert.DeepEqual(t, map[string]bool{"a published post": true}, byAuthor)
+	all := listContents("?all=true&limit=100", readerToken)
+	assert.Assert(t, !all["a draft"] && !all["a scheduled post"])
+
+	assert.Equal(t, http.StatusNotFound, serveWithToken("GET", "/blogs/"+draftId, nil, readerToken).Code)
+	assert.Equal(t, http.StatusOK, serveWithToken("GET", "/blogs/"+draftId, nil, token).Code)
+	assert.Equal(t, http.StatusOK, serveWithToken("GET", "/blogs/"+draftId, nil, editorToken).Code)
+	w = serveWithToken("POST", "/comments/insert/"+draftId, CommentRequest{Comment: "sneaky"}, readerToken)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	draftObjectId, _ := primitive.ObjectIDFromHex(draftId)
+	noteId := createTestComment(t, draftObjectId, author.ID, "a note on the draft")
+	listsNote := func(token string) bool {
+		w := serveWithToken("GET", "/comments/", nil, token)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var comments []CommentResponse
+		_ = json.Unmarshal(w.Body.Bytes(), &comments)
+		for _, comment := range comments {
+			if comment.ID == noteId {
+				return true
+			}
+		}
+		return false
+	}
+	assert.Assert(t, !listsNote(readerToken))
+	assert.Assert(t, listsNote(token))
+	assert.Assert(t, listsNote(editorToken))
+
+	// the publisher flips the post once it is due, dated as scheduled
+	count, err := publishDueBlogs(context.TODO(), time.Now())
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusNotFound, serveWithToken("GET", "/blogs/"+scheduledId, nil, readerToken).Code)
+	count, err = publishDueBlogs(context.TODO(), publishAt.Add(time.Second))
+	assert.NilError(t, err)
+	assert.Assert(t, count >= 1)
+	var blog Blog
+	scheduledObjectId, _ := primitive.ObjectIDFromHex(scheduledId)
+	assert.NilError(t, db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": scheduledObjectId}).Decode(&blog))
+	assert.Equal(t, BlogPublished, blog.Status)
+	assert.Assert(t, blog.PublishAt == nil)
+	assert.Equal(t, publishAt.UnixMilli(), blog.PublishedDate.UnixMilli())
+	assert.Equal(t, http.StatusOK, serveWithToken("GET", "/blogs/"+scheduledId, nil, readerToken).Code)
+
+	var response BlogResponse
+	w = serveWithToken("PUT", "/blog/"+draftId+"/status", BlogStatusRequest{Status: BlogPublished}, readerToken)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = serveWithToken("PUT", "/blog/"+draftId+"/status", BlogStatusRequest{Status: BlogScheduled}, token)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serveWithToken("PUT", "/blog/"+draftId+"/status", BlogStatusRequest{Status: BlogPublished}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, BlogPublished, response.Status)
+	assert.Assert(t, !response.PublishedDate.IsZero())
+	assert.Assert(t, listContents("?author="+author.ID.Hex(), readerToken)["a draft"])
+
+	w = serveWithToken("PUT", "/blog/"+draftId+"/status", BlogStatusRequest{Status: BlogArchived}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusNotFound, serveWithToken("GET", "/blogs/"+draftId, nil, readerToken).Code)
+}
+
+func TestMarkdownRendering(t *testing.T) {
+	user, token := createTestUser(t, "markdown-author", RoleAuthor)
+	source := "# Heading\n\n<script>alert(1)</script>\n\nSome **bold** text.\n"
+	w := serveWithToken("POST", "/blog/insert", BlogRequest{Title: "Markdown", Content: source}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var inserted map[string]string
+	_ = json.Unmarshal(w.Body.Bytes(), &inserted)
+
+	var blog BlogDetail
+	w = serveWithToken("GET", "/blogs/"+inserted["ID"], nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &blog)
+	assert.Equal(t, source, blog.Content)
+	assert.Assert(t, strings.Contains(blog.ContentHTML, "<h1>Heading</h1>"))
+	assert.Assert(t, strings.Contains(blog.ContentHTML, "<strong>bold</strong>"))
+	assert.Assert(t, !strings.Contains(blog.ContentHTML, "<script"))
+
+	// editing replaces the cached HTML
+	w = serveWithToken("PUT", "/blog/"+inserted["ID"], BlogUpdateRequest{Title: "Markdown", Content: "_edited_"}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stored Blog
+	blogId, _ := primitive.ObjectIDFromHex(inserted["ID"])
+	assert.NilError(t, db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": blogId}).Decode(&stored))
+	assert.Equal(t, "<p><em>edited</em></p>\n", stored.ContentHTML)
+	assert.Equal(t, renderVersion, stored.RenderVersion)
+
+	// blogs and comments stored before rendering are rendered when read,
+	// and the HTML is kept
+	legacyId := createTestBlog(t, user.ID, "*legacy*")
+	w = serveWithToken("GET", "/blogs/"+legacyId.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &blog)
+	assert.Equal(t, "<p><em>legacy</em></p>\n", blog.ContentHTML)
+	assert.NilError(t, db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": legacyId}).Decode(&stored))
+	assert.Equal(t, blog.ContentHTML, stored.ContentHTML)
+	assert.Equal(t, renderVersion, stored.RenderVersion)
+	legacyCommentId := createTestComment(t, legacyId, user.ID, "*old*")
+	w = serveWithToken("GET", "/comments/", nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var legacyComment Comment
+	assert.NilError(t, db.Collection("comments").FindOne(context.TODO(), bson.M{"_id": legacyCommentId}).Decode(&legacyComment))
+	assert.Equal(t, "<p><em>old</em></p>\n", legacyComment.TextHTML)
+	assert.Equal(t, renderVersion, legacyComment.RenderVersion)
+	// empty content is stored without a content field
+	emptyId := createTestBlog(t, user.ID, "")
+	w = serveWithToken("GET", "/blogs/"+emptyId.Hex(), nil, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NilError(t, db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": emptyId}).Decode(&stored))
+	assert.Equal(t, renderVersion, stored.RenderVersion)
+
+	w = serveWithToken("POST", "/comments/insert/"+inserted["ID"], CommentRequest{Comment: "nice `code`"}, token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var comment Comment
+	assert.NilError(t, db.Collection("comments").FindOne(context.TODO(), bson.M{"blog_id": blogId}).Decode(&comment))
+	assert.Equal(t, "nice `code`", comment.Text)
+	assert.Equal(t, "<p>nice <code>code</code></p>\n", newCommentResponse(comment).TextHTML)
+	assert.Equal(t, comment.TextHTML, newCommentResponse(comment).TextHTML)
+}
+
 func TestGetAllUsers(t *testing.T) {
 	cookieToken := &http.Cookie{
 		Name:     "token",
@@ -205,6 +1982,7 @@ func TestInsertBlog(t *testing.T) {
 	jsonValue, _ := json.Marshal(br)
 	req, _ := http.NewRequest("POST", "/blog/insert", bytes.NewBuffer(jsonValue))
 	req.Header["Cookie"] = []string{cookieToken.String()}
+	withCSRF(req)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -228,6 +2006,7 @@ func TestInsertCommentByBlogID(t *testing.T) {
 	jsonValue, _ := json.Marshal(cr)
 	req, _ := http.NewRequest("POST", fmt.Sprintf("/comments/insert/%s", testUser["blogID"]), bytes.NewBuffer(jsonValue))
 	req.Header["Cookie"] = []string{cookieToken.String()}
+	withCSRF(req)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -265,6 +2044,7 @@ func TestDeleteComments(t *testing.T) {
 	path := fmt.Sprintf("/comments/delete/%s/%s", testUser["blogID"], testUser["commentID"])
 	req, _ := http.NewRequest("DELETE", path, nil)
 	req.Header["Cookie"] = []string{cookieToken.String()}
+	withCSRF(req)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -283,6 +2063,7 @@ func TestDeleteBlogByID(t *testing.T) {
 	}
 	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/blog/%s", testUser["blogID"]), nil)
 	req.Header["Cookie"] = []string{cookieToken.String()}
+	withCSRF(req)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
@@ -301,6 +2082,7 @@ func TestDeleteUserByID(t *testing.T) {
 	}
 	req, _ := http.NewRequest("DELETE", fmt.Sprintf("/users/%s", testUser["ID"]), nil)
 	req.Header["Cookie"] = []string{cookieToken.String()}
+	withCSRF(req)
 	w := httptest.NewRecorder()
 
 	router.ServeHTTP(w, req)
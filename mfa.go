@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const PurposeMFALogin = "mfa_login"
+
+const recoveryCodeCount = 10
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type MFALoginRequest struct {
+	Challenge    string `json:"challenge" binding:"required"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// EnrollTOTP generates a new secret for the caller. It only takes effect
+// once ConfirmTOTP has seen a valid code for it.
+func EnrollTOTP(c *gin.Context) {
+	principal := currentPrincipal(c)
+	var user User
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"_id": principal.UserID, "deleted_at": notDeleted}).Decode(&user); err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if user.TOTPEnabled {
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": "Two-factor authentication is already enabled"})
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	update := bson.M{"$set": bson.M{"totp_secret": secret}}
+	if _, err := db.Collection("users").UpdateByID(context.TODO(), user.ID, update); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"secret":           secret,
+		"provisioning_uri": totpProvisioningURI(totpIssuer, user.Name, secret),
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication and hands out the recovery
+// codes. They are only ever shown here.
+func ConfirmTOTP(c *gin.Context) {
+	principal := currentPrincipal(c)
+	req := TOTPCodeRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	var user User
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"_id": principal.UserID, "deleted_at": notDeleted}).Decode(&user); err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if user.TOTPEnabled {
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if user.TOTPSecret == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Enroll before confirming"})
+		return
+	}
+	step, ok := validateTOTP(user.TOTPSecret, req.Code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Invalid code"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashToken(code)
+	}
+	update := bson.M{"$set": bson.M{
+		"totp_enabled":   true,
+		"totp_last_step": step,
+		"recovery_codes": hashes,
+	}}
+	if _, err := db.Collection("users").UpdateByID(context.TODO(), user.ID, update); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// startMFAChallenge answers a correct password for an enrolled user with a
+// short-lived challenge instead of a session.
+func startMFAChallenge(c *gin.Context, user User) {
+	challenge, err := issueActionToken(context.TODO(), user.ID, PurposeMFALogin, mfaChallengeTTL)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Invalid username or password"})
+		return
+	}
+	c.IndentedJSON(http.StatusAccepted, gin.H{
+		"Message":      "Two-factor authentication required",
+		"mfa_required": true,
+		"challenge":    challenge,
+	})
+}
+
+// CompleteMFALogin exchanges an MFA challenge plus a TOTP or recovery code
+// for a session.
+func CompleteMFALogin(c *gin.Context) {
+	req := MFALoginRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "") == (req.RecoveryCode == "") {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Provide the challenge and either a code or a recovery code"})
+		return
+	}
+	claims := &ActionClaims{}
+	if err := parseClaims(req.Challenge, claims); err != nil || claims.Purpose != PurposeMFALogin {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid or expired challenge"})
+		return
+	}
+	userID, _ := primitive.ObjectIDFromHex(claims.Subject)
+	var user User
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"_id": userID, "deleted_at": notDeleted}).Decode(&user); err != nil || !user.TOTPEnabled {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid or expired challenge"})
+		return
+	}
+
+	// codes are guessable too, so they share the password's counters
+	throttleKeys := loginThrottleKeys(user.Name, c.ClientIP())
+	if !checkLoginThrottle(c, throttleKeys) {
+		return
+	}
+	var verified bool
+	if req.Code != "" {
+		verified = useTOTPCode(context.TODO(), user, req.Code)
+	} else {
+		verified = useRecoveryCode(context.TODO(), user, req.RecoveryCode)
+	}
+	if !verified {
+		recordLoginFailures(context.TODO(), throttleKeys)
+		recordAudit(c, AuditEvent{Action: AuditLoginFailed, ActorID: user.ID, ActorName: user.Name, Details: map[string]string{"reason": "wrong code"}})
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid code"})
+		return
+	}
+	resetLoginFailures(context.TODO(), user.Name)
+	// the challenge is single-use, like the code that answered it
+	if _, err := consumeActionToken(context.TODO(), req.Challenge, PurposeMFALogin); err != nil {
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid or expired challenge"})
+		return
+	}
+	if err := startSession(c, user); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	recordAudit(c, AuditEvent{Action: AuditLogin, ActorID: user.ID, ActorName: user.Name, Details: map[string]string{"method": "password+totp"}})
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Login successful"})
+}
+
+// useTOTPCode validates code and records its time step so it cannot be
+// replayed, even by a concurrent request.
+func useTOTPCode(ctx context.Context, user User, code string) bool {
+	step, ok := validateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	filter := bson.M{"_id": user.ID, "$or": bson.A{
+		bson.M{"totp_last_step": bson.M{"$lt": step}},
+		bson.M{"totp_last_step": bson.M{"$exists": false}},
+	}}
+	result, err := db.Collection("users").UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp_last_step": step}})
+	return err == nil && result.ModifiedCount == 1
+}
+
+// useRecoveryCode removes code from the user's remaining recovery codes.
+func useRecoveryCode(ctx context.Context, user User, code string) bool {
+	hash := hashToken(normalizeRecoveryCode(code))
+	filter := bson.M{"_id": user.ID, "recovery_codes": hash}
+	result, err := db.Collection("users").UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"recovery_codes": hash}})
+	return err == nil && result.ModifiedCount == 1
+}
@@ -7,26 +7,90 @@ import (
 )
 
 type Comment struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty"`
-	Text        string             `bson:"blog_text"`
-	CommentDate time.Time          `bson:"comment_date"`
-	UpVote      int                `bson:"up_votes"`
-	DownVote    int                `bson:"down_votes"`
+	ID   primitive.ObjectID `bson:"_id,omitempty"`
+	Text string             `bson:"blog_text"`
+	// TextHTML caches Text rendered by renderer RenderVersion.
+	TextHTML      string             `bson:"text_html,omitempty"`
+	RenderVersion int                `bson:"render_version,omitempty"`
+	AuthorID      primitive.ObjectID `bson:"author_id,omitempty"`
+	BlogID        primitive.ObjectID `bson:"blog_id,omitempty"`
+	CommentDate   time.Time          `bson:"comment_date"`
+	UpVote        int                `bson:"up_votes"`
+	DownVote      int                `bson:"down_votes"`
+	DeletedAt     *time.Time         `bson:"deleted_at,omitempty"`
 }
 
 // models
 type Blog struct {
-	ID            primitive.ObjectID   `bson:"_id,omitempty"`
-	Content       string               `bson:"content,omitempty"`
-	Comments      []primitive.ObjectID `bson:"comments"`
-	PublishedDate time.Time            `bson:"pub_date"`
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Title   string             `bson:"title,omitempty"`
+	Slug    string             `bson:"slug,omitempty"`
+	Summary string             `bson:"summary,omitempty"`
+	Content string             `bson:"content,omitempty"`
+	// ContentHTML caches Content rendered by renderer RenderVersion.
+	ContentHTML   string `bson:"content_html,omitempty"`
+	RenderVersion int    `bson:"render_version,omitempty"`
+	// AuthorID duplicates the blogrecords entry; blogs written before it
+	// was added only have the record.
+	AuthorID primitive.ObjectID   `bson:"author_id,omitempty"`
+	Comments []primitive.ObjectID `bson:"comments"`
+	Status   BlogStatus           `bson:"status,omitempty"`
+	// PublishAt is when a scheduled blog goes out.
+	PublishAt *time.Time `bson:"publish_at,omitempty"`
+	// PublishedDate is unset on blogs that were never published.
+	PublishedDate time.Time `bson:"pub_date"`
+	UpdatedAt     time.Time `bson:"updated_at,omitempty"`
+	// Revision numbers the versions of the blog from 1; it is unset on
+	// blogs never edited. EditedBy wrote the current version.
+	Revision  int                `bson:"revision,omitempty"`
+	EditedBy  primitive.ObjectID `bson:"edited_by,omitempty"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty"`
+}
+
+// BlogRevision is a version of a blog that was replaced by an edit.
+type BlogRevision struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	BlogID   primitive.ObjectID `bson:"blog_id"`
+	Number   int                `bson:"number"`
+	Title    string             `bson:"title,omitempty"`
+	Summary  string             `bson:"summary,omitempty"`
+	Content  string             `bson:"content"`
+	EditedBy primitive.ObjectID `bson:"edited_by,omitempty"`
+	EditedAt time.Time          `bson:"edited_at"`
+	// ReplacedAt is when the next version was saved.
+	ReplacedAt time.Time `bson:"replaced_at"`
 }
 
 type User struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty"`
-	Password    string             `bson:"password"`
+	Password    string             `bson:"password" json:"-"`
 	Name        string             `bson:"name"`
 	Description string             `bson:"Description"`
+	Roles       []Role             `bson:"roles,omitempty"`
+	// Email is empty for accounts registered before addresses were
+	// collected; those are not required to verify one.
+	Email         string `bson:"email,omitempty"`
+	EmailVerified bool   `bson:"email_verified"`
+	// TOTPSecret is set on enrollment; TOTPEnabled once it was confirmed.
+	TOTPSecret    string   `bson:"totp_secret,omitempty" json:"-"`
+	TOTPEnabled   bool     `bson:"totp_enabled"`
+	TOTPLastStep  int64    `bson:"totp_last_step,omitempty" json:"-"`
+	RecoveryCodes []string `bson:"recovery_codes,omitempty" json:"-"`
+	// OIDCIssuer and OIDCSubject link the account to a single sign-on
+	// identity. Accounts created through sign-on have no password.
+	OIDCIssuer  string `bson:"oidc_issuer,omitempty" json:"-"`
+	OIDCSubject string `bson:"oidc_subject,omitempty" json:"-"`
+	// DeletedAt is set while the account is in the trash.
+	DeletedAt *time.Time `bson:"deleted_at,omitempty"`
+}
+
+// EffectiveRoles returns the user's roles, falling back to defaultRole for
+// accounts stored before roles were introduced.
+func (u User) EffectiveRoles() []Role {
+	if len(u.Roles) == 0 {
+		return []Role{defaultRole}
+	}
+	return u.Roles
 }
 
 type BlogRecord struct {
@@ -34,3 +98,110 @@ type BlogRecord struct {
 	UserID primitive.ObjectID `bson:"user_id,omitempty"`
 	BlogID primitive.ObjectID `bson:"blog_id,omitempty"`
 }
+
+// RefreshToken is a single-use token that can be exchanged for a new access
+// token. Every rotation issues a new token in the same family; presenting a
+// token that was already used revokes the whole family.
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	FamilyID  primitive.ObjectID `bson:"family_id"`
+	TokenHash string             `bson:"token_hash"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty"`
+	RevokedAt *time.Time         `bson:"revoked_at,omitempty"`
+}
+
+// Session is a login on one device. Its ID is also the family ID of its
+// refresh tokens and the sid claim of its access tokens.
+type Session struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	UserID     primitive.ObjectID `bson:"user_id"`
+	UserAgent  string             `bson:"user_agent"`
+	IP         string             `bson:"ip"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	LastSeenAt time.Time          `bson:"last_seen_at"`
+	ExpiresAt  time.Time          `bson:"expires_at"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty"`
+}
+
+// APIKey is a personal access token letting automation act as a user, sent
+// as X-API-Key or as a Bearer token. Only a hash of the key is stored. A key
+// without scopes (issued by the create-api-key command) is not restricted
+// beyond the user's roles.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	UserID     primitive.ObjectID `bson:"user_id"`
+	Name       string             `bson:"name"`
+	KeyHash    string             `bson:"key_hash" json:"-"`
+	Scopes     []Permission       `bson:"scopes,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	ExpiresAt  *time.Time         `bson:"expires_at,omitempty"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty"`
+}
+
+// Usable reports whether the key may still authenticate requests.
+func (k APIKey) Usable(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// LoginAttempt counts recent failed logins for one throttling key, either
+// an account ("user:<name>") or a client address ("ip:<addr>").
+type LoginAttempt struct {
+	Key           string     `bson:"_id" json:"key"`
+	Failures      int        `bson:"failures" json:"failures"`
+	LastFailureAt time.Time  `bson:"last_failure_at" json:"last_failure_at"`
+	LockedUntil   *time.Time `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+	ExpiresAt     time.Time  `bson:"expires_at" json:"-"`
+}
+
+// OIDCState remembers an authentication request sent to the OpenID
+// provider until its callback arrives. ID is the hash of the state value.
+type OIDCState struct {
+	ID           string    `bson:"_id"`
+	CodeVerifier string    `bson:"code_verifier"`
+	Nonce        string    `bson:"nonce"`
+	CreatedAt    time.Time `bson:"created_at"`
+	ExpiresAt    time.Time `bson:"expires_at"`
+}
+
+// ActionToken records a single-purpose token (email verification, password
+// reset) so that it can be used only once.
+type ActionToken struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"user_id"`
+	Purpose   string             `bson:"purpose"`
+	CreatedAt time.Time          `bson:"created_at"`
+	ExpiresAt time.Time          `bson:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty"`
+}
+
+// Follow records that FollowerID follows the author FolloweeID.
+type Follow struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	FollowerID primitive.ObjectID `bson:"follower_id"`
+	FolloweeID primitive.ObjectID `bson:"followee_id"`
+	CreatedAt  time.Time          `bson:"created_at"`
+}
+
+// DataExport tracks an export archive built in the background; the archive
+// itself is stored in exportDir.
+type DataExport struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	UserID      primitive.ObjectID `bson:"user_id"`
+	Status      ExportStatus       `bson:"status"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	CompletedAt *time.Time         `bson:"completed_at,omitempty"`
+	ExpiresAt   time.Time          `bson:"expires_at"`
+	Size        int64              `bson:"size,omitempty"`
+	// Requester is who asked for the export, recorded in the audit log
+	// once the export is ready.
+	RequesterID   primitive.ObjectID `bson:"requester_id,omitempty"`
+	RequesterName string             `bson:"requester_name,omitempty"`
+	RequesterIP   string             `bson:"requester_ip,omitempty"`
+}
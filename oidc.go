@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	ErrOIDCDiscovery  = errors.New("oidc: provider discovery failed")
+	ErrOIDCExchange   = errors.New("oidc: code exchange failed")
+	ErrIDTokenInvalid = errors.New("oidc: invalid id token")
+)
+
+// oidcClockSkew is tolerated between our clock and the provider's when
+// checking the time claims of an ID token.
+const oidcClockSkew = time.Minute
+
+// oidcKeyRefreshInterval limits how often an unknown kid may trigger a new
+// JWKS download, so that forged tokens cannot hammer the provider.
+const oidcKeyRefreshInterval = 10 * time.Second
+
+var oidcSigningAlgorithms = []string{"RS256", "ES256", "EdDSA"}
+
+// OIDCConfig is our client registration with the OpenID provider.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// HTTPClient talks to the provider; nil means a client with a short
+	// timeout.
+	HTTPClient *http.Client
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider runs the relying party side of the authorization code flow
+// with PKCE against one provider.
+type OIDCProvider struct {
+	config   OIDCConfig
+	metadata oidcMetadata
+
+	mu            sync.Mutex
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+// DiscoverOIDCProvider reads the provider metadata from the issuer's
+// well-known configuration document.
+func DiscoverOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	p := &OIDCProvider{config: config}
+	wellKnown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &p.metadata); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCDiscovery, err)
+	}
+	if p.metadata.Issuer != config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q does not match %q", ErrOIDCDiscovery, p.metadata.Issuer, config.Issuer)
+	}
+	if p.metadata.AuthorizationEndpoint == "" || p.metadata.TokenEndpoint == "" || p.metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: incomplete metadata", ErrOIDCDiscovery)
+	}
+	return p, nil
+}
+
+func (p *OIDCProvider) Issuer() string {
+	return p.config.Issuer
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// pkceChallenge derives the S256 code challenge for verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where the user agent is sent to authenticate.
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) string {
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.config.ClientID)
+	params.Set("redirect_uri", p.config.RedirectURL)
+	params.Set("scope", strings.Join(p.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", pkceChallenge(verifier))
+	params.Set("code_challenge_method", "S256")
+	separator := "?"
+	if strings.Contains(p.metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.metadata.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// Exchange redeems an authorization code and returns the raw ID token.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.config.ClientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	resp, err := p.config.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOIDCExchange, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrOIDCExchange, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s %s", ErrOIDCExchange, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("%w: no id_token in response", ErrOIDCExchange)
+	}
+	return body.IDToken, nil
+}
+
+// audience accepts the aud claim both as a single string and as a list.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type IDTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp,omitempty"`
+	ExpiresAt         int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	NotBefore         int64    `json:"nbf,omitempty"`
+	Nonce             string   `json:"nonce,omitempty"`
+	Email             string   `json:"email,omitempty"`
+	EmailVerified     bool     `json:"email_verified,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+}
+
+// Valid checks the time claims; VerifyIDToken checks the rest.
+func (c *IDTokenClaims) Valid() error {
+	now := time.Now()
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(oidcClockSkew)) {
+		return errors.New("token is expired")
+	}
+	if c.NotBefore != 0 && now.Add(oidcClockSkew).Before(time.Unix(c.NotBefore, 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if c.IssuedAt != 0 && now.Add(oidcClockSkew).Before(time.Unix(c.IssuedAt, 0)) {
+		return errors.New("token used before issued")
+	}
+	return nil
+}
+
+// VerifyIDToken checks the signature and claims of an ID token issued to us
+// in answer to an authentication request carrying nonce.
+func (p *OIDCProvider) VerifyIDToken(ctx context.Context, raw, nonce string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	parser := &jwt.Parser{ValidMethods: oidcSigningAlgorithms}
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.verificationKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIDTokenInvalid, err)
+	}
+	switch {
+	case claims.Issuer != p.config.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrIDTokenInvalid, claims.Issuer)
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, fmt.Errorf("%w: not issued to this client", ErrIDTokenInvalid)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID:
+		return nil, fmt.Errorf("%w: not authorized for this client", ErrIDTokenInvalid)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrIDTokenInvalid)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrIDTokenInvalid)
+	}
+	return claims, nil
+}
+
+// verificationKey returns the provider key with the given kid, downloading
+// the JWKS again when the provider may have rotated its keys.
+func (p *OIDCProvider) verificationKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetchedAt) < oidcKeyRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+	var set JWKSet
+	if err := p.getJSON(ctx, p.metadata.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			// keys of types we do not support are not fatal
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookupKey finds kid among the cached keys. A token without kid is only
+// accepted while the provider publishes a single key.
+func (p *OIDCProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"gotest.tools/assert"
+)
+
+const mockClientID = "blog-api-test"
+
+// mockOIDCProvider is a minimal OpenID provider for tests. Instead of a
+// login page, authorize plays the part of a user signing in.
+type mockOIDCProvider struct {
+	*httptest.Server
+	keys *KeyRing
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	m := &mockOIDCProvider{keys: NewKeyRing(""), codes: map[string]mockAuthorization{}}
+	_, err := m.keys.Rotate("RS256")
+	assert.NilError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(m.keys.JWKS())
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockOIDCProvider) config() OIDCConfig {
+	return OIDCConfig{
+		Issuer:      m.URL,
+		ClientID:    mockClientID,
+		RedirectURL: "http://localhost/users/oidc/callback",
+		Scopes:      []string{"openid", "email"},
+	}
+}
+
+// authorize accepts the authentication request at authURL for a user with
+// the given claims and returns the code and state of the redirect back.
+func (m *mockOIDCProvider) authorize(t *testing.T, authURL string, claims jwt.MapClaims) (string, string) {
+	u, err := url.Parse(authURL)
+	assert.NilError(t, err)
+	query := u.Query()
+	assert.Equal(t, mockClientID, query.Get("client_id"))
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+
+	idClaims := jwt.MapClaims{
+		"iss":   m.URL,
+		"aud":   mockClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for k, v := range claims {
+		idClaims[k] = v
+	}
+	code, err := generateToken(16)
+	assert.NilError(t, err)
+	m.mu.Lock()
+	m.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), claims: idClaims}
+	m.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (m *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	auth, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mu.Unlock()
+	if !ok || r.FormValue("client_id") != mockClientID || pkceChallenge(r.FormValue("code_verifier")) != auth.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	key := m.keys.ActiveKey()
+	token := jwt.NewWithClaims(key.signingMethod(), auth.claims)
+	token.Header["kid"] = key.ID
+	signed, _ := token.SignedString(key.privateKey)
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "unused", "token_type": "Bearer", "id_token": signed})
+}
+
+func TestOIDCCodeFlow(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider, err := DiscoverOIDCProvider(context.Background(), mock.config())
+	assert.NilError(t, err)
+
+	authURL := provider.AuthCodeURL("the-state", "the-nonce", "the-verifier-the-verifier-the-verifier-123")
+	code, state := mock.authorize(t, authURL, jwt.MapClaims{"sub": "alice", "email": "alice@example.com", "email_verified": true})
+	assert.Equal(t, "the-state", state)
+
+	raw, err := provider.Exchange(context.Background(), code, "the-verifier-the-verifier-the-verifier-123")
+	assert.NilError(t, err)
+	claims, err := provider.VerifyIDToken(context.Background(), raw, "the-nonce")
+	assert.NilError(t, err)
+	assert.Equal(t, "alice", claims.Subject)
+	assert.Equal(t, "alice@example.com", claims.Email)
+	assert.Assert(t, claims.EmailVerified)
+}
+
+func TestOIDCExchangeRequiresVerifier(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider, err := DiscoverOIDCProvider(context.Background(), mock.config())
+	assert.NilError(t, err)
+
+	code, _ := mock.authorize(t, provider.AuthCodeURL("s", "n", "the-verifier-the-verifier-the-verifier-123"), jwt.MapClaims{"sub": "alice"})
+	_, err = provider.Exchange(context.Background(), code, "some-other-verifier-some-other-verifier-12")
+	assert.Assert(t, errors.Is(err, ErrOIDCExchange))
+}
+
+func TestVerifyIDTokenRejectsBadClaims(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	provider, err := DiscoverOIDCProvider(context.Background(), mock.config())
+	assert.NilError(t, err)
+	verifier := "the-verifier-the-verifier-the-verifier-123"
+
+	cases := map[string]jwt.MapClaims{
+		"wrong audience": {"sub": "alice", "aud": "someone-else"},
+		"wrong issuer":   {"sub": "alice", "iss": "https://evil.example.com"},
+		"expired":        {"sub": "alice", "exp": time.Now().Add(-time.Hour).Unix()},
+		"wrong nonce":    {"sub": "alice", "nonce": "replayed"},
+		"no subject":     {},
+	}
+	for name, claims := range cases {
+		code, _ := mock.authorize(t, provider.AuthCodeURL("s", "n", verifier), claims)
+		raw, err := provider.Exchange(context.Background(), code, verifier)
+		assert.NilError(t, err)
+		_, err = provider.VerifyIDToken(context.Background(), raw, "n")
+		assert.Assert(t, errors.Is(err, ErrIDTokenInvalid), name)
+	}
+}
+
+func TestOIDCDiscoveryChecksIssuer(t *testing.T) {
+	mock := newMockOIDCProvider(t)
+	config := mock.config()
+	config.Issuer = mock.URL + "/"
+	_, err := DiscoverOIDCProvider(context.Background(), config)
+	assert.Assert(t, errors.Is(err, ErrOIDCDiscovery))
+}
+
+func TestAudienceUnmarshal(t *testing.T) {
+	var claims IDTokenClaims
+	assert.NilError(t, json.Unmarshal([]byte(`{"aud":"a"}`), &claims))
+	assert.DeepEqual(t, audience{"a"}, claims.Audience)
+	assert.NilError(t, json.Unmarshal([]byte(`{"aud":["a","b"]}`), &claims))
+	assert.DeepEqual(t, audience{"a", "b"}, claims.Audience)
+}
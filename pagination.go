@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// pageCursor points just past the last item of a page of results sorted
+// newest first. The ID breaks ties between items with the same time. Times
+// are kept to the millisecond, as MongoDB stores them.
+type pageCursor struct {
+	Time time.Time
+	ID   primitive.ObjectID
+}
+
+func (p pageCursor) String() string {
+	raw := strconv.FormatInt(p.Time.UnixMilli(), 10) + ":" + p.ID.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parsePageCursor(s string) (pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	millis, hexID, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return pageCursor{}, errInvalidCursor
+	}
+	n, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	id, err := primitive.ObjectIDFromHex(hexID)
+	if err != nil {
+		return pageCursor{}, errInvalidCursor
+	}
+	return pageCursor{Time: time.UnixMilli(n), ID: id}, nil
+}
+
+// after matches the items that come after the cursor when sorting by
+// timeField and idField, both descending.
+func (p pageCursor) after(timeField, idField string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{timeField: bson.M{"$lt": p.Time}},
+		bson.M{timeField: p.Time, idField: bson.M{"$lt": p.ID}},
+	}}
+}
+
+// pageParams reads the cursor and limit query parameters. The cursor is
+// nil on the first page.
+func pageParams(c *gin.Context) (*pageCursor, int, error) {
+	limit := defaultPageSize
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, 0, errors.New("invalid limit")
+		}
+		if n > maxPageSize {
+			n = maxPageSize
+		}
+		limit = n
+	}
+	s := c.Query("cursor")
+	if s == "" {
+		return nil, limit, nil
+	}
+	cursor, err := parsePageCursor(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &cursor, limit, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gotest.tools/assert"
+)
+
+func TestPageCursorRoundTrip(t *testing.T) {
+	cursor := pageCursor{Time: time.UnixMilli(1700000000123), ID: primitive.NewObjectID()}
+	parsed, err := parsePageCursor(cursor.String())
+	assert.NilError(t, err)
+	assert.Assert(t, parsed.Time.Equal(cursor.Time))
+	assert.Equal(t, cursor.ID, parsed.ID)
+}
+
+func TestPageCursorKeepsZeroTime(t *testing.T) {
+	// drafts carry a zero publish date, which nanoseconds cannot hold
+	parsed, err := parsePageCursor(pageCursor{ID: primitive.NewObjectID()}.String())
+	assert.NilError(t, err)
+	assert.Assert(t, parsed.Time.Equal(time.Time{}))
+}
+
+func TestParsePageCursorRejectsGarbage(t *testing.T) {
+	for _, s := range []string{"", "not base64!", "bm9jb2xvbg", "MTIzOm5vdGFuaWQ"} {
+		_, err := parsePageCursor(s)
+		assert.Equal(t, errInvalidCursor, err, s)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+// PasswordHasher hashes and verifies user passwords. Encoded hashes carry
+// their algorithm and parameters, so a hasher can tell when a stored hash
+// was produced with different settings and should be replaced.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, encoded string) (bool, error)
+	NeedsRehash(encoded string) bool
+}
+
+// Argon2idHasher produces PHC formatted hashes:
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+type Argon2idHasher struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.Memory ||
+		params.Iterations != h.Iterations ||
+		params.Parallelism != h.Parallelism ||
+		uint32(len(salt)) != h.SaltLength ||
+		uint32(len(key)) != h.KeyLength
+}
+
+// checkArgon2Params rejects settings argon2.IDKey cannot work with: it
+// panics on zero iterations or parallelism, and needs at least 8 KiB of
+// memory per lane.
+func checkArgon2Params(memory, iterations, parallelism int) error {
+	if iterations < 1 || iterations > math.MaxUint32 {
+		return fmt.Errorf("argon2 iterations %d out of range", iterations)
+	}
+	if parallelism < 1 || parallelism > math.MaxUint8 {
+		return fmt.Errorf("argon2 parallelism %d out of range", parallelism)
+	}
+	if memory < 8*parallelism || memory > math.MaxUint32 {
+		return fmt.Errorf("argon2 memory %d KiB out of range for parallelism %d", memory, parallelism)
+	}
+	return nil
+}
+
+func decodeArgon2id(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, err
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	var memory, iterations, parallelism int
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkArgon2Params(memory, iterations, parallelism); err != nil {
+		return nil, nil, nil, err
+	}
+	params := &Argon2idHasher{Memory: uint32(memory), Iterations: uint32(iterations), Parallelism: uint8(parallelism)}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// an empty key would match any password's empty key
+	if len(salt) == 0 || len(key) == 0 {
+		return nil, nil, nil, ErrUnknownHashFormat
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// BcryptHasher produces standard $2a$ bcrypt hashes.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// legacyMD5Hasher verifies the unsalted upper-case hex MD5 digests that
+// accounts registered before argon2id/bcrypt support still carry. It is only
+// used to verify; such hashes are always upgraded on the next login.
+type legacyMD5Hasher struct{}
+
+func (legacyMD5Hasher) Hash(password string) (string, error) {
+	return fmt.Sprintf("%X", md5.Sum([]byte(password))), nil
+}
+
+func (h legacyMD5Hasher) Verify(password, encoded string) (bool, error) {
+	hash, _ := h.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToUpper(encoded))) == 1, nil
+}
+
+func (legacyMD5Hasher) NeedsRehash(encoded string) bool {
+	return true
+}
+
+func isLegacyMD5(encoded string) bool {
+	if len(encoded) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+// verifierFor picks the hasher able to verify encoded based on its format.
+func verifierFor(encoded string) (PasswordHasher, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return &Argon2idHasher{}, nil
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return &BcryptHasher{}, nil
+	case isLegacyMD5(encoded):
+		return legacyMD5Hasher{}, nil
+	}
+	return nil, ErrUnknownHashFormat
+}
+
+// CheckPassword verifies password against a stored hash of any supported
+// format. When the password matches, rehash reports whether the stored hash
+// should be replaced by one produced with h.
+func CheckPassword(h PasswordHasher, password, encoded string) (match bool, rehash bool, err error) {
+	verifier, err := verifierFor(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	match, err = verifier.Verify(password, encoded)
+	if err != nil || !match {
+		return false, false, err
+	}
+	return true, h.NeedsRehash(encoded), nil
+}
+
+// NewPasswordHasher returns the hasher named by algorithm ("argon2id" or
+// "bcrypt") configured with the given cost settings.
+func NewPasswordHasher(algorithm string, argonMemory, argonIterations, argonParallelism, bcryptCost int) (PasswordHasher, error) {
+	switch algorithm {
+	case "argon2id":
+		if err := checkArgon2Params(argonMemory, argonIterations, argonParallelism); err != nil {
+			return nil, err
+		}
+		return &Argon2idHasher{
+			Memory:      uint32(argonMemory),
+			Iterations:  uint32(argonIterations),
+			Parallelism: uint8(argonParallelism),
+			SaltLength:  16,
+			KeyLength:   32,
+		}, nil
+	case "bcrypt":
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost %d out of range", bcryptCost)
+		}
+		return &BcryptHasher{Cost: bcryptCost}, nil
+	}
+	return nil, fmt.Errorf("unknown password hasher %q", algorithm)
+}
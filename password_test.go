@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestArgon2idHashAndVerify(t *testing.T) {
+	hasher, _ := NewPasswordHasher("argon2id", 1024, 1, 1, 0)
+	encoded, err := hasher.Hash("correct horse")
+	assert.NilError(t, err)
+	assert.Assert(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	match, rehash, err := CheckPassword(hasher, "correct horse", encoded)
+	assert.NilError(t, err)
+	assert.Assert(t, match)
+	assert.Assert(t, !rehash)
+
+	match, _, _ = CheckPassword(hasher, "battery staple", encoded)
+	assert.Assert(t, !match)
+}
+
+func TestBcryptHashAndVerify(t *testing.T) {
+	hasher, _ := NewPasswordHasher("bcrypt", 0, 0, 0, 4)
+	encoded, err := hasher.Hash("correct horse")
+	assert.NilError(t, err)
+
+	match, rehash, err := CheckPassword(hasher, "correct horse", encoded)
+	assert.NilError(t, err)
+	assert.Assert(t, match)
+	assert.Assert(t, !rehash)
+
+	stronger, _ := NewPasswordHasher("bcrypt", 0, 0, 0, 5)
+	_, rehash, _ = CheckPassword(stronger, "correct horse", encoded)
+	assert.Assert(t, rehash)
+}
+
+func TestLegacyMD5HashNeedsRehash(t *testing.T) {
+	hasher, _ := NewPasswordHasher("argon2id", 1024, 1, 1, 0)
+	legacy, _ := legacyMD5Hasher{}.Hash("testpassword")
+
+	match, rehash, err := CheckPassword(hasher, "testpassword", legacy)
+	assert.NilError(t, err)
+	assert.Assert(t, match)
+	assert.Assert(t, rehash)
+
+	match, _, _ = CheckPassword(hasher, "wrongpassword", legacy)
+	assert.Assert(t, !match)
+}
+
+func TestArgon2idParameterChangeNeedsRehash(t *testing.T) {
+	weak, _ := NewPasswordHasher("argon2id", 1024, 1, 1, 0)
+	strong, _ := NewPasswordHasher("argon2id", 2048, 2, 1, 0)
+	encoded, _ := weak.Hash("correct horse")
+
+	_, rehash, _ := CheckPassword(strong, "correct horse", encoded)
+	assert.Assert(t, rehash)
+}
+
+func TestCheckPasswordUnknownFormat(t *testing.T) {
+	hasher, _ := NewPasswordHasher("argon2id", 1024, 1, 1, 0)
+	match, _, err := CheckPassword(hasher, "whatever", "not-a-hash")
+	assert.Equal(t, ErrUnknownHashFormat, err)
+	assert.Assert(t, !match)
+}
+
+func TestArgon2idRejectsInvalidParameters(t *testing.T) {
+	for _, params := range [][3]int{{1024, 0, 1}, {1024, 1, 0}, {1024, 1, 256}, {7, 1, 1}, {64, 1, 9}} {
+		_, err := NewPasswordHasher("argon2id", params[0], params[1], params[2], 0)
+		assert.Assert(t, err != nil, "%v", params)
+	}
+
+	hasher, _ := NewPasswordHasher("argon2id", 1024, 1, 1, 0)
+	for _, encoded := range []string{
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=256$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=1,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5",
+		// an empty key compares equal to an empty key
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHQ$",
+	} {
+		match, _, err := CheckPassword(hasher, "anything", encoded)
+		assert.Assert(t, err != nil, encoded)
+		assert.Assert(t, !match)
+	}
+}
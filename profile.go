@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ProfileRequest holds the profile fields to change; absent fields are
+// left as they are.
+type ProfileRequest struct {
+	Description *string `json:"description"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type UsernameChangeRequest struct {
+	Username        string `json:"username" binding:"required"`
+	CurrentPassword string `json:"current_password"`
+}
+
+func UpdateProfile(c *gin.Context) {
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	req := ProfileRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	fields := bson.M{}
+	if req.Description != nil {
+		fields["Description"] = *req.Description
+	}
+	if len(fields) == 0 {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Nothing to update"})
+		return
+	}
+	filter := bson.M{"_id": userId, "deleted_at": notDeleted}
+	result, err := db.Collection("users").UpdateOne(context.TODO(), filter, bson.M{"$set": fields})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if result.MatchedCount == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Profile updated"})
+}
+
+// credentialTarget loads the user whose credentials are about to change.
+// Access tokens may not change credentials, so a leaked one cannot be used
+// to take the account over.
+func credentialTarget(c *gin.Context) (User, bool) {
+	var user User
+	if currentPrincipal(c).Method == AuthAPIKey {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"Error": "Credentials cannot be changed with an access token"})
+		return user, false
+	}
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return user, false
+	}
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"_id": userId, "deleted_at": notDeleted}).Decode(&user); err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return user, false
+	}
+	return user, true
+}
+
+// endSessionsAfterCredentialChange revokes every session of user. When the
+// user changed their own credentials the caller gets a fresh session so
+// that only the other devices are logged out.
+func endSessionsAfterCredentialChange(c *gin.Context, userID primitive.ObjectID) {
+	if err := revokeUserSessions(context.TODO(), userID); err != nil {
+		log.Println("revoking sessions after credential change failed:", err)
+	}
+	if currentPrincipal(c).UserID != userID {
+		return
+	}
+	var user User
+	if err := db.Collection("users").FindOne(context.TODO(), bson.M{"_id": userID}).Decode(&user); err != nil {
+		log.Println("loading user after credential change failed:", err)
+		return
+	}
+	if err := startSession(c, user); err != nil {
+		log.Println("starting session after credential change failed:", err)
+	}
+}
+
+// confirmPassword checks the current password given to change credentials.
+// Wrong guesses count against the same throttle as logins, so that a stolen
+// session cannot be used to guess the password. It responds itself and
+// returns false unless the password matches.
+func confirmPassword(c *gin.Context, user User, password string) bool {
+	throttleKeys := loginThrottleKeys(user.Name, c.ClientIP())
+	if !checkLoginThrottle(c, throttleKeys) {
+		return false
+	}
+	match, _, err := CheckPassword(passwordHasher, password, user.Password)
+	if err != nil || !match {
+		recordLoginFailures(context.TODO(), throttleKeys)
+		c.IndentedJSON(http.StatusForbidden, gin.H{"Error": "Current password is incorrect"})
+		return false
+	}
+	resetLoginFailures(context.TODO(), user.Name)
+	return true
+}
+
+func ChangePassword(c *gin.Context) {
+	req := PasswordChangeRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	user, ok := credentialTarget(c)
+	if !ok {
+		return
+	}
+	if !confirmPassword(c, user, req.CurrentPassword) {
+		return
+	}
+	hashedPassword, err := passwordHasher.Hash(req.NewPassword)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	update := bson.M{"$set": bson.M{"password": hashedPassword}}
+	if _, err := db.Collection("users").UpdateByID(context.TODO(), user.ID, update); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	// a password changed after a compromise must lock out access tokens
+	// made with it too
+	revoked, err := revokeAPIKeys(context.TODO(), user.ID)
+	if err != nil {
+		log.Println("revoking access tokens after password change failed:", err)
+	}
+	endSessionsAfterCredentialChange(c, user.ID)
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Password updated", "revoked_access_tokens": revoked})
+}
+
+// ChangeUsername renames a user. Accounts that have a password must confirm
+// it; accounts created through single sign-on have none.
+func ChangeUsername(c *gin.Context) {
+	req := UsernameChangeRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	username := strings.TrimSpace(req.Username)
+	if username == "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Username must not be empty"})
+		return
+	}
+	user, ok := credentialTarget(c)
+	if !ok {
+		return
+	}
+	if user.Password != "" && !confirmPassword(c, user, req.CurrentPassword) {
+		return
+	}
+	if username == user.Name {
+		c.IndentedJSON(http.StatusOK, gin.H{"Message": "Username updated", "username": username})
+		return
+	}
+
+	var existing User
+	err := db.Collection("users").FindOne(context.TODO(), bson.M{"name": username}).Decode(&existing)
+	if err != mongo.ErrNoDocuments {
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+			return
+		}
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": "Username already exist, choose a different name."})
+		return
+	}
+	update := bson.M{"$set": bson.M{"name": username}}
+	if _, err := db.Collection("users").UpdateByID(context.TODO(), user.ID, update); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			// taken since the check above
+			c.IndentedJSON(http.StatusConflict, gin.H{"Error": "Username already exist, choose a different name."})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	// access tokens carry the old name
+	endSessionsAfterCredentialChange(c, user.ID)
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Username updated", "username": username})
+}
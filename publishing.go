@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A blog is a draft, scheduled for a publish time, published or archived.
+// Only published blogs are shown to anyone but their owner. Scheduled blogs
+// count as published from their publish time on, whether or not the
+// publisher has flipped their status yet, so a stopped publisher delays
+// nothing; it catches up when it starts again.
+
+type BlogStatus string
+
+const (
+	BlogDraft     BlogStatus = "draft"
+	BlogScheduled BlogStatus = "scheduled"
+	BlogPublished BlogStatus = "published"
+	BlogArchived  BlogStatus = "archived"
+)
+
+var ErrInvalidSchedule = errors.New("scheduled blogs need a publish_at time in the future")
+
+func validBlogStatus(status BlogStatus) bool {
+	switch status {
+	case BlogDraft, BlogScheduled, BlogPublished, BlogArchived:
+		return true
+	}
+	return false
+}
+
+// blogStatus is the status of blog; blogs stored before statuses existed
+// are published.
+func blogStatus(blog Blog) BlogStatus {
+	if blog.Status == "" {
+		return BlogPublished
+	}
+	return blog.Status
+}
+
+// blogPublic reports whether anyone may see blog at now.
+func blogPublic(blog Blog, now time.Time) bool {
+	switch blogStatus(blog) {
+	case BlogPublished:
+		return true
+	case BlogScheduled:
+		return blog.PublishAt != nil && !blog.PublishAt.After(now)
+	}
+	return false
+}
+
+// publicBlogFilter matches the blogs anyone may see at now, with the blog
+// fields under prefix ("" or "blog.").
+func publicBlogFilter(prefix string, now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{prefix + "status": bson.M{"$exists": false}},
+		bson.M{prefix + "status": BlogPublished},
+		bson.M{prefix + "status": BlogScheduled, prefix + "publish_at": bson.M{"$lte": now}},
+	}}
+}
+
+// statusUpdate returns the fields to set to move blog to status. Scheduling
+// needs publishAt after now; publishing for the first time stamps the
+// publish date.
+func statusUpdate(blog Blog, status BlogStatus, publishAt *time.Time, now time.Time) (bson.M, bson.M, error) {
+	set := bson.M{"status": status}
+	unset := bson.M{}
+	switch status {
+	case BlogScheduled:
+		if publishAt == nil || !publishAt.After(now) {
+			return nil, nil, ErrInvalidSchedule
+		}
+		set["publish_at"] = *publishAt
+		// a scheduled blog is dated when it goes out
+		set["pub_date"] = *publishAt
+	case BlogPublished:
+		unset["publish_at"] = ""
+		if blog.PublishedDate.IsZero() || blogStatus(blog) == BlogScheduled {
+			set["pub_date"] = now
+		}
+	default:
+		unset["publish_at"] = ""
+		if blogStatus(blog) == BlogScheduled {
+			// it never went out
+			set["pub_date"] = time.Time{}
+		}
+	}
+	return set, unset, nil
+}
+
+// publishDueBlogs publishes the scheduled blogs whose time has come. Their
+// publish date is the time they were scheduled for.
+func publishDueBlogs(ctx context.Context, now time.Time) (int64, error) {
+	filter := bson.M{"status": BlogScheduled, "publish_at": bson.M{"$lte": now}}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"status": BlogPublished, "pub_date": "$publish_at"}}},
+		{{Key: "$unset", Value: "publish_at"}},
+	}
+	result, err := db.Collection("blogs").UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// runPublisher publishes due blogs right away, covering any that fell due
+// while the server was down, and then every interval.
+func runPublisher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		count, err := publishDueBlogs(context.Background(), time.Now())
+		if err != nil {
+			log.Println("publishing scheduled blogs failed:", err)
+		} else if count > 0 {
+			log.Printf("published %d scheduled blogs", count)
+		}
+		<-ticker.C
+	}
+}
+
+// canSeeBlog reports whether principal may see blog, which is the case for
+// public blogs, the owner's own and anyone who may edit every blog.
+func canSeeBlog(ctx context.Context, principal Principal, blog Blog) (bool, error) {
+	if blogPublic(blog, time.Now()) || principal.Reach(PermBlogsWrite) == ReachAny {
+		return true, nil
+	}
+	authorID, err := blogAuthorID(ctx, blog)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return authorID == principal.UserID, err
+}
+
+// publishing handlers
+
+type BlogStatusRequest struct {
+	Status    BlogStatus `json:"status" binding:"required"`
+	PublishAt *time.Time `json:"publish_at"`
+}
+
+// SetBlogStatus moves a blog to another status, scheduling it when the
+// status is scheduled.
+func SetBlogStatus(c *gin.Context) {
+	req := BlogStatusRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if !validBlogStatus(req.Status) {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "status must be draft, scheduled, published or archived"})
+		return
+	}
+	blog, ok := findEditableBlog(c)
+	if !ok {
+		return
+	}
+	set, unset, err := statusUpdate(blog, req.Status, req.PublishAt, time.Now())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	filter := bson.M{"_id": blog.ID, "deleted_at": notDeleted}
+	if err := db.Collection("blogs").FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&blog); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, newBlogResponse(blog))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestBlogPublic(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	assert.Assert(t, blogPublic(Blog{}, now))
+	assert.Assert(t, blogPublic(Blog{Status: BlogPublished}, now))
+	assert.Assert(t, !blogPublic(Blog{Status: BlogDraft}, now))
+	assert.Assert(t, !blogPublic(Blog{Status: BlogArchived}, now))
+	assert.Assert(t, !blogPublic(Blog{Status: BlogScheduled, PublishAt: &future}, now))
+	// due but not yet flipped by the publisher
+	assert.Assert(t, blogPublic(Blog{Status: BlogScheduled, PublishAt: &past}, now))
+}
+
+func TestStatusUpdate(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+
+	_, _, err := statusUpdate(Blog{Status: BlogDraft}, BlogScheduled, &past, now)
+	assert.Assert(t, errors.Is(err, ErrInvalidSchedule))
+	_, _, err = statusUpdate(Blog{Status: BlogDraft}, BlogScheduled, nil, now)
+	assert.Assert(t, errors.Is(err, ErrInvalidSchedule))
+
+	set, _, err := statusUpdate(Blog{Status: BlogDraft}, BlogScheduled, &future, now)
+	assert.NilError(t, err)
+	assert.Equal(t, future, set["publish_at"])
+	assert.Equal(t, future, set["pub_date"])
+
+	set, unset, err := statusUpdate(Blog{Status: BlogDraft}, BlogPublished, nil, now)
+	assert.NilError(t, err)
+	assert.Equal(t, now, set["pub_date"])
+	_, ok := unset["publish_at"]
+	assert.Assert(t, ok)
+
+	// unarchiving keeps the original date
+	set, _, _ = statusUpdate(Blog{Status: BlogArchived, PublishedDate: past}, BlogPublished, nil, now)
+	_, ok = set["pub_date"]
+	assert.Assert(t, !ok)
+
+	set, _, _ = statusUpdate(Blog{Status: BlogScheduled, PublishAt: &future, PublishedDate: future}, BlogDraft, nil, now)
+	assert.Assert(t, set["pub_date"].(time.Time).IsZero())
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type Role string
+
+const (
+	RoleAdmin  Role = "admin"
+	RoleEditor Role = "editor"
+	RoleAuthor Role = "author"
+	RoleReader Role = "reader"
+)
+
+// defaultRole is given to new accounts and assumed for accounts created
+// before roles existed.
+const defaultRole = RoleAuthor
+
+func validRole(role Role) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+type Permission string
+
+const (
+	PermUsersRead     Permission = "users:read"
+	PermUsersWrite    Permission = "users:write"
+	PermUsersAdmin    Permission = "users:admin"
+	PermBlogsRead     Permission = "blogs:read"
+	PermBlogsWrite    Permission = "blogs:write"
+	PermCommentsRead  Permission = "comments:read"
+	PermCommentsWrite Permission = "comments:write"
+)
+
+// Reach is how far a granted permission extends.
+type Reach int
+
+const (
+	ReachNone Reach = iota
+	// ReachOwn allows acting on resources the caller owns.
+	ReachOwn
+	// ReachAny allows acting on anyone's resources.
+	ReachAny
+)
+
+var rolePermissions = map[Role]map[Permission]Reach{
+	RoleAdmin: {
+		PermUsersRead:     ReachAny,
+		PermUsersWrite:    ReachAny,
+		PermUsersAdmin:    ReachAny,
+		PermBlogsRead:     ReachAny,
+		PermBlogsWrite:    ReachAny,
+		PermCommentsRead:  ReachAny,
+		PermCommentsWrite: ReachAny,
+	},
+	RoleEditor: {
+		PermUsersRead:     ReachAny,
+		PermUsersWrite:    ReachOwn,
+		PermBlogsRead:     ReachAny,
+		PermBlogsWrite:    ReachAny,
+		PermCommentsRead:  ReachAny,
+		PermCommentsWrite: ReachAny,
+	},
+	RoleAuthor: {
+		PermUsersRead:     ReachAny,
+		PermUsersWrite:    ReachOwn,
+		PermBlogsRead:     ReachAny,
+		PermBlogsWrite:    ReachOwn,
+		PermCommentsRead:  ReachAny,
+		PermCommentsWrite: ReachOwn,
+	},
+	RoleReader: {
+		PermUsersRead:     ReachAny,
+		PermUsersWrite:    ReachOwn,
+		PermBlogsRead:     ReachAny,
+		PermCommentsRead:  ReachAny,
+		PermCommentsWrite: ReachOwn,
+	},
+}
+
+// reachFor returns the widest reach any of roles grants for perm.
+func reachFor(roles []Role, perm Permission) Reach {
+	reach := ReachNone
+	for _, role := range roles {
+		if r := rolePermissions[role][perm]; r > reach {
+			reach = r
+		}
+	}
+	return reach
+}
+
+// Reach returns how far the principal may use perm, honouring the scopes
+// of an API key.
+func (p Principal) Reach(perm Permission) Reach {
+	if p.Scopes != nil && !containsPermission(p.Scopes, perm) {
+		return ReachNone
+	}
+	return reachFor(p.Roles, perm)
+}
+
+// RoutePolicy is the permission a route requires. Owners resolves who owns
+// the resource the route acts on; callers whose roles only grant ReachOwn
+// must be among them. Routes that act on no existing resource (listing,
+// creating) leave Owners nil.
+type RoutePolicy struct {
+	Permission Permission
+	Owners     func(c *gin.Context) ([]primitive.ObjectID, error)
+}
+
+// routePolicies is keyed by method and route pattern, as in "DELETE /blog/:id".
+// Routes missing from it are not checked by Authorize.
+var routePolicies = map[string]RoutePolicy{
+	"GET /users":                                 {Permission: PermUsersRead},
+	"GET /users/:id":                             {Permission: PermUsersRead},
+	"DELETE /users/:id":                          {Permission: PermUsersWrite, Owners: userFromParam("id")},
+	"PATCH /users/:id":                           {Permission: PermUsersWrite, Owners: userFromParam("id")},
+	"PUT /users/:id/password":                    {Permission: PermUsersWrite, Owners: userFromParam("id")},
+	"PUT /users/:id/username":                    {Permission: PermUsersWrite, Owners: userFromParam("id")},
+	"PUT /users/:id/roles":                       {Permission: PermUsersAdmin},
+	"DELETE /users/:id/lockout":                  {Permission: PermUsersAdmin},
+	"GET /users/:id/export":                      {Permission: PermUsersWrite, Owners: userFromParam("id")},
+	"POST /users/:id/export":                     {Permission: PermUsersWrite, Owners: userFromParam("id")},
+	"GET /users/:id/exports/:export_id":          {Permission: PermUsersWrite, Owners: userFromParam("id")},
+	"GET /users/:id/exports/:export_id/download": {Permission: PermUsersWrite, Owners: userFromParam("id")},
+	// following changes only the caller's own follow list
+	"POST /users/:id/follow":   {Permission: PermUsersWrite},
+	"DELETE /users/:id/follow": {Permission: PermUsersWrite},
+	"GET /users/:id/followers": {Permission: PermUsersRead},
+	"GET /users/:id/following": {Permission: PermUsersRead},
+
+	"GET /feed":             {Permission: PermBlogsRead},
+	"GET /blogs":            {Permission: PermBlogsRead},
+	"GET /blogs/:id":        {Permission: PermBlogsRead},
+	"GET /blogs/slug/:slug": {Permission: PermBlogsRead},
+	"POST /blog/insert":     {Permission: PermBlogsWrite},
+	"DELETE /blog/:id":      {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+	"PUT /blog/:id":         {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+	"PUT /blog/:id/status":  {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+	// earlier versions may hold what the author took out, so only those
+	// who may edit the blog see them
+	"GET /blog/:id/revisions":               {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+	"GET /blog/:id/revisions/:rev":          {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+	"POST /blog/:id/revisions/:rev/restore": {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+	"GET /blog/:id/diff":                    {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+
+	"GET /comments/":                               {Permission: PermCommentsRead},
+	"POST /comments/insert/:blog_id":               {Permission: PermCommentsWrite},
+	"DELETE /comments/delete/:blog_id/:comment_id": {Permission: PermCommentsWrite, Owners: commentOwners("blog_id", "comment_id")},
+
+	"GET /audit":        {Permission: PermUsersAdmin},
+	"GET /audit/verify": {Permission: PermUsersAdmin},
+
+	"GET /trash/blogs":                 {Permission: PermBlogsWrite},
+	"POST /trash/blogs/:id/restore":    {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+	"DELETE /trash/blogs/:id":          {Permission: PermBlogsWrite, Owners: blogOwners("id")},
+	"GET /trash/comments":              {Permission: PermCommentsWrite},
+	"POST /trash/comments/:id/restore": {Permission: PermCommentsWrite, Owners: trashedCommentOwners("id")},
+	"DELETE /trash/comments/:id":       {Permission: PermCommentsWrite, Owners: trashedCommentOwners("id")},
+	"GET /trash/users":                 {Permission: PermUsersAdmin},
+	"POST /trash/users/:id/restore":    {Permission: PermUsersAdmin},
+	"DELETE /trash/users/:id":          {Permission: PermUsersAdmin},
+}
+
+var errInvalidID = errors.New("invalid id")
+
+func objectIDParam(c *gin.Context, name string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(c.Param(name))
+	if err != nil {
+		return primitive.NilObjectID, errInvalidID
+	}
+	return id, nil
+}
+
+// userFromParam treats the user named by the route parameter as the owner of
+// their own account.
+func userFromParam(param string) func(c *gin.Context) ([]primitive.ObjectID, error) {
+	return func(c *gin.Context) ([]primitive.ObjectID, error) {
+		userID, err := objectIDParam(c, param)
+		if err != nil {
+			return nil, err
+		}
+		return []primitive.ObjectID{userID}, nil
+	}
+}
+
+// blogOwners looks the blog named by the route parameter up in blogrecords.
+func blogOwners(param string) func(c *gin.Context) ([]primitive.ObjectID, error) {
+	return func(c *gin.Context) ([]primitive.ObjectID, error) {
+		blogID, err := objectIDParam(c, param)
+		if err != nil {
+			return nil, err
+		}
+		var record BlogRecord
+		if err := db.Collection("blogrecords").FindOne(context.TODO(), bson.M{"blog_id": blogID}).Decode(&record); err != nil {
+			return nil, err
+		}
+		return []primitive.ObjectID{record.UserID}, nil
+	}
+}
+
+// commentOwners resolves both the comment's author and the owner of the blog
+// it sits on. A comment that is not attached to the named blog is reported as
+// missing, so owning one blog grants nothing over comments on another.
+func commentOwners(blogParam, commentParam string) func(c *gin.Context) ([]primitive.ObjectID, error) {
+	return func(c *gin.Context) ([]primitive.ObjectID, error) {
+		blogID, err := objectIDParam(c, blogParam)
+		if err != nil {
+			return nil, err
+		}
+		commentID, err := objectIDParam(c, commentParam)
+		if err != nil {
+			return nil, err
+		}
+		var blog Blog
+		if err := db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": blogID, "deleted_at": notDeleted}).Decode(&blog); err != nil {
+			return nil, err
+		}
+		if !containsID(blog.Comments, commentID) {
+			return nil, mongo.ErrNoDocuments
+		}
+		var comment Comment
+		if err := db.Collection("comments").FindOne(context.TODO(), bson.M{"_id": commentID, "deleted_at": notDeleted}).Decode(&comment); err != nil {
+			return nil, err
+		}
+
+		owners, err := blogOwners(blogParam)(c)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+		if !comment.AuthorID.IsZero() {
+			owners = append(owners, comment.AuthorID)
+		}
+		return owners, nil
+	}
+}
+
+// trashedCommentOwners resolves the author of a trashed comment and the
+// owner of the blog it was left on.
+func trashedCommentOwners(param string) func(c *gin.Context) ([]primitive.ObjectID, error) {
+	return func(c *gin.Context) ([]primitive.ObjectID, error) {
+		commentID, err := objectIDParam(c, param)
+		if err != nil {
+			return nil, err
+		}
+		var comment Comment
+		if err := db.Collection("comments").FindOne(context.TODO(), bson.M{"_id": commentID, "deleted_at": inTrash}).Decode(&comment); err != nil {
+			return nil, err
+		}
+		owners := []primitive.ObjectID{}
+		var record BlogRecord
+		err = db.Collection("blogrecords").FindOne(context.TODO(), bson.M{"blog_id": comment.BlogID}).Decode(&record)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+		if err == nil {
+			owners = append(owners, record.UserID)
+		}
+		if !comment.AuthorID.IsZero() {
+			owners = append(owners, comment.AuthorID)
+		}
+		return owners, nil
+	}
+}
+
+func validPermission(perm Permission) bool {
+	_, ok := rolePermissions[RoleAdmin][perm]
+	return ok
+}
+
+// Authorize enforces routePolicies against the Principal stored by
+// Authenticate, which must run first. Scoped API keys are limited to routes
+// with a policy whose permission is among their scopes.
+func Authorize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := currentPrincipal(c)
+		policy, ok := routePolicies[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			if principal.Scopes != nil {
+				deny(c, "Token scope does not allow this action")
+				return
+			}
+			c.Next()
+			return
+		}
+		if principal.UserID.IsZero() {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+			return
+		}
+		if principal.Scopes != nil && !containsPermission(principal.Scopes, policy.Permission) {
+			deny(c, "Token scope does not allow this action")
+			return
+		}
+
+		reach := reachFor(principal.Roles, policy.Permission)
+		if reach == ReachOwn && policy.Owners != nil {
+			owners, err := policy.Owners(c)
+			switch {
+			case err == errInvalidID:
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+				return
+			case err == mongo.ErrNoDocuments:
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "Not found"})
+				return
+			case err != nil:
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+				return
+			}
+			if !containsID(owners, principal.UserID) {
+				reach = ReachNone
+			}
+		}
+		if reach == ReachNone {
+			deny(c, "Permission denied")
+			return
+		}
+		c.Next()
+	}
+}
+
+// deny answers 403 and records the refusal in the audit log.
+func deny(c *gin.Context, message string) {
+	recordAudit(c, AuditEvent{
+		Action:  AuditPermissionDenied,
+		Details: map[string]string{"route": c.Request.Method + " " + c.FullPath(), "path": c.Request.URL.Path, "reason": message},
+	})
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Error": message})
+}
+
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPermission(perms []Permission, perm Permission) bool {
+	for _, other := range perms {
+		if other == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Blogs and comments are written in Markdown: CommonMark, which includes
+// fenced code blocks, plus tables and footnotes. The HTML is rendered when
+// the text is saved and stored next to it, tagged with renderVersion; HTML
+// from an older renderer, or none at all, is rendered again and stored when
+// read.
+
+// renderVersion must be increased whenever the Markdown options or the
+// sanitizer policy change.
+const renderVersion = 1
+
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.Table, extension.Footnote),
+)
+
+// htmlPolicy is the allowlist rendered HTML is passed through. It keeps
+// the formatting Markdown produces and drops scripts, styles, event handler
+// attributes and javascript: URLs; goldmark already leaves out raw HTML, so
+// this is a second line of defence.
+var htmlPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	// fenced code blocks carry their language for syntax highlighting
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+	return policy
+}()
+
+// renderMarkdown converts source to sanitized HTML.
+func renderMarkdown(source string) string {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		// goldmark only fails when writing to buf fails
+		return htmlPolicy.Sanitize(source)
+	}
+	return htmlPolicy.Sanitize(buf.String())
+}
+
+// blogHTML returns the rendered content of blog, from its cache if that is
+// current.
+func blogHTML(blog Blog) string {
+	if blog.RenderVersion == renderVersion {
+		return blog.ContentHTML
+	}
+	return renderMarkdown(blog.Content)
+}
+
+// commentHTML returns the rendered text of comment, from its cache if that
+// is current.
+func commentHTML(comment Comment) string {
+	if comment.RenderVersion == renderVersion {
+		return comment.TextHTML
+	}
+	return renderMarkdown(comment.Text)
+}
+
+// unchangedText matches a stored text field that still holds text. Empty
+// text may be stored as an empty string or, with omitempty, not at all.
+func unchangedText(text string) interface{} {
+	if text == "" {
+		return bson.M{"$in": bson.A{nil, ""}}
+	}
+	return text
+}
+
+// cacheBlogHTML renders blog and stores the HTML if its cache is out of
+// date, unless the content changed in the meantime.
+func cacheBlogHTML(ctx context.Context, blog Blog) Blog {
+	if blog.RenderVersion == renderVersion {
+		return blog
+	}
+	blog.ContentHTML = renderMarkdown(blog.Content)
+	blog.RenderVersion = renderVersion
+	filter := bson.M{"_id": blog.ID, "content": unchangedText(blog.Content), "render_version": bson.M{"$ne": renderVersion}}
+	update := bson.M{"$set": bson.M{"content_html": blog.ContentHTML, "render_version": renderVersion}}
+	if _, err := db.Collection("blogs").UpdateOne(ctx, filter, update); err != nil {
+		log.Printf("caching the HTML of blog %s failed: %v", blog.ID.Hex(), err)
+	}
+	return blog
+}
+
+// cacheCommentHTML is cacheBlogHTML for comments.
+func cacheCommentHTML(ctx context.Context, comment Comment) Comment {
+	if comment.RenderVersion == renderVersion {
+		return comment
+	}
+	comment.TextHTML = renderMarkdown(comment.Text)
+	comment.RenderVersion = renderVersion
+	filter := bson.M{"_id": comment.ID, "blog_text": unchangedText(comment.Text), "render_version": bson.M{"$ne": renderVersion}}
+	update := bson.M{"$set": bson.M{"text_html": comment.TextHTML, "render_version": renderVersion}}
+	if _, err := db.Collection("comments").UpdateOne(ctx, filter, update); err != nil {
+		log.Printf("caching the HTML of comment %s failed: %v", comment.ID.Hex(), err)
+	}
+	return comment
+}
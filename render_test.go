@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	html := renderMarkdown("# Title\n\nSome *emphasis* and a [link](https://example.com).\n")
+	assert.Assert(t, strings.Contains(html, "<h1>Title</h1>"), html)
+	assert.Assert(t, strings.Contains(html, "<em>emphasis</em>"), html)
+	assert.Assert(t, strings.Contains(html, `<a href="https://example.com" rel="nofollow">link</a>`), html)
+
+	html = renderMarkdown("| a | b |\n|---|---|\n| 1 | 2 |\n")
+	assert.Assert(t, strings.Contains(html, "<table>"), html)
+	assert.Assert(t, strings.Contains(html, "<td>2</td>"), html)
+
+	html = renderMarkdown("```go\nfmt.Println(\"<hi>\")\n```\n")
+	assert.Assert(t, strings.Contains(html, `<pre><code class="language-go">`), html)
+	assert.Assert(t, strings.Contains(html, "&lt;hi&gt;"), html)
+
+	html = renderMarkdown("A claim.[^1]\n\n[^1]: The source.\n")
+	assert.Assert(t, strings.Contains(html, `href="#fn:1"`), html)
+	assert.Assert(t, strings.Contains(html, "The source."), html)
+}
+
+func TestRenderMarkdownSanitizes(t *testing.T) {
+	for _, source := range []string{
+		"<script>alert(1)</script>",
+		"<img src=x onerror=alert(1)>",
+		"[click](javascript:alert(1))",
+		"<a href=\"javascript:alert(1)\">x</a>",
+		"<iframe src=\"https://example.com\"></iframe>",
+		"```\" onmouseover=\"alert(1)\n```",
+	} {
+		html := renderMarkdown(source)
+		for _, banned := range []string{"<script", "onerror", "javascript:", "<iframe", "onmouseover=\""} {
+			assert.Assert(t, !strings.Contains(html, banned), "%q rendered to %q", source, html)
+		}
+	}
+	// only language classes survive on code
+	assert.Equal(t, "<code>x</code>", htmlPolicy.Sanitize(`<code class="evil" style="color:red">x</code>`))
+}
+
+func TestRenderCache(t *testing.T) {
+	blog := Blog{Content: "*new*", ContentHTML: "<p>cached</p>", RenderVersion: renderVersion}
+	assert.Equal(t, "<p>cached</p>", blogHTML(blog))
+	blog.RenderVersion = renderVersion - 1
+	assert.Equal(t, "<p><em>new</em></p>\n", blogHTML(blog))
+	assert.Equal(t, "<p><strong>hi</strong></p>\n", commentHTML(Comment{Text: "**hi**"}))
+}
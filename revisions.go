@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every edit of a blog first copies the version it replaces into the
+// blogrevisions collection, numbered like the blog's revision field. The
+// blog itself always holds the newest version, so revisions 1 up to
+// Revision-1 are in blogrevisions and Revision is the blog.
+
+var (
+	ErrEditConflict     = errors.New("blog was edited concurrently")
+	ErrRevisionNotFound = errors.New("revision not found")
+)
+
+type BlogUpdateRequest struct {
+	Title   string `json:"title" binding:"max=200"`
+	Summary string `json:"summary" binding:"max=500"`
+	Content string `json:"content" binding:"required"`
+	// Revision, when given, is the revision the edit was based on; the
+	// edit fails with 409 if the blog has moved on since.
+	Revision int `json:"revision"`
+}
+
+type RevisionSummary struct {
+	Number   int                `json:"Number"`
+	Title    string             `json:"Title"`
+	EditedBy primitive.ObjectID `json:"EditedBy"`
+	EditedAt time.Time          `json:"EditedAt"`
+	Current  bool               `json:"Current"`
+}
+
+type RevisionResponse struct {
+	RevisionSummary
+	Summary string `json:"Summary"`
+	Content string `json:"Content"`
+}
+
+// currentRevision is the number of the version blog holds. Blogs never
+// edited are at revision 1.
+func currentRevision(blog Blog) int {
+	if blog.Revision == 0 {
+		return 1
+	}
+	return blog.Revision
+}
+
+// blogRevision returns the current version of blog as a revision.
+func blogRevision(blog Blog) BlogRevision {
+	editedBy, editedAt := blog.EditedBy, blog.UpdatedAt
+	if editedBy.IsZero() {
+		editedBy = blog.AuthorID
+	}
+	if editedAt.IsZero() {
+		editedAt = blog.PublishedDate
+	}
+	return BlogRevision{
+		BlogID:   blog.ID,
+		Number:   currentRevision(blog),
+		Title:    blog.Title,
+		Summary:  blog.Summary,
+		Content:  blog.Content,
+		EditedBy: editedBy,
+		EditedAt: editedAt,
+	}
+}
+
+func newRevisionResponse(revision BlogRevision, current bool) RevisionResponse {
+	return RevisionResponse{
+		RevisionSummary: RevisionSummary{
+			Number:   revision.Number,
+			Title:    revision.Title,
+			EditedBy: revision.EditedBy,
+			EditedAt: revision.EditedAt,
+			Current:  current,
+		},
+		Summary: revision.Summary,
+		Content: revision.Content,
+	}
+}
+
+// editBlog archives the current version of blog and replaces it with the
+// given one written by editor. It fails with ErrEditConflict when another
+// edit saved first. The slug is kept so that links stay valid.
+func editBlog(ctx context.Context, blog Blog, editor primitive.ObjectID, title, summary, content string) (Blog, error) {
+	now := time.Now()
+	archived := blogRevision(blog)
+	archived.ID = primitive.NewObjectID()
+	archived.ReplacedAt = now
+	// the unique blog_id and number index lets only one edit archive a
+	// given version
+	if _, err := db.Collection("blogrevisions").InsertOne(ctx, archived); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return blog, ErrEditConflict
+		}
+		return blog, err
+	}
+
+	if summary == "" {
+		summary = summarize(content)
+	}
+	filter := bson.M{"_id": blog.ID, "deleted_at": notDeleted, "revision": blog.Revision}
+	if blog.Revision == 0 {
+		filter["revision"] = bson.M{"$exists": false}
+	}
+	update := bson.M{"$set": bson.M{
+		"title":   title,
+		"summary": summary,
+		"content": content,
+		// the cached HTML is replaced along with the content
+		"content_html":   renderMarkdown(content),
+		"render_version": renderVersion,
+		"updated_at":     now,
+		"revision":       archived.Number + 1,
+		"edited_by":      editor,
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var edited Blog
+	err := db.Collection("blogs").FindOneAndUpdate(ctx, filter, update, opts).Decode(&edited)
+	if err == mongo.ErrNoDocuments {
+		// trashed or edited in between; the archived copy matches nothing
+		_, _ = db.Collection("blogrevisions").DeleteOne(ctx, bson.M{"_id": archived.ID})
+		return blog, ErrEditConflict
+	}
+	return edited, err
+}
+
+// findRevision returns revision number of blog, which may be the current
+// version.
+func findRevision(ctx context.Context, blog Blog, number int) (BlogRevision, error) {
+	if number == currentRevision(blog) {
+		return blogRevision(blog), nil
+	}
+	var revision BlogRevision
+	err := db.Collection("blogrevisions").FindOne(ctx, bson.M{"blog_id": blog.ID, "number": number}).Decode(&revision)
+	if err == mongo.ErrNoDocuments {
+		return revision, ErrRevisionNotFound
+	}
+	return revision, err
+}
+
+// findEditableBlog loads the blog named by the id parameter, responding
+// itself when that fails.
+func findEditableBlog(c *gin.Context) (Blog, bool) {
+	var blog Blog
+	blogId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return blog, false
+	}
+	if err := db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": blogId, "deleted_at": notDeleted}).Decode(&blog); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Blog not found"})
+			return blog, false
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return blog, false
+	}
+	return blog, true
+}
+
+// revisionParam parses a revision number; "current" names the current one.
+func revisionParam(blog Blog, value string) (int, error) {
+	if value == "current" {
+		return currentRevision(blog), nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 1 {
+		return 0, errors.New("revision must be a positive number or current")
+	}
+	return number, nil
+}
+
+// respondEditError responds to a failed editBlog.
+func respondEditError(c *gin.Context, err error) {
+	if errors.Is(err, ErrEditConflict) {
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": "The blog was changed by someone else, reload it and try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+}
+
+// revision handlers
+
+// UpdateBlog replaces the title, summary and content of a blog, keeping the
+// previous version as a revision.
+func UpdateBlog(c *gin.Context) {
+	principal := currentPrincipal(c)
+	req := BlogUpdateRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.Error(err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	blog, ok := findEditableBlog(c)
+	if !ok {
+		return
+	}
+	if req.Revision != 0 && req.Revision != currentRevision(blog) {
+		respondEditError(c, ErrEditConflict)
+		return
+	}
+	blog, err := editBlog(context.TODO(), blog, principal.UserID, strings.TrimSpace(req.Title), strings.TrimSpace(req.Summary), req.Content)
+	if err != nil {
+		respondEditError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, newBlogResponse(blog))
+}
+
+// ListRevisions lists every version of a blog, newest first.
+func ListRevisions(c *gin.Context) {
+	blog, ok := findEditableBlog(c)
+	if !ok {
+		return
+	}
+	opts := options.Find().SetSort(bson.M{"number": -1}).SetProjection(bson.M{"content": 0, "summary": 0})
+	cursor, err := db.Collection("blogrevisions").Find(context.TODO(), bson.M{"blog_id": blog.ID}, opts)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	revisions := []BlogRevision{}
+	if err = cursor.All(context.TODO(), &revisions); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	response := []RevisionSummary{newRevisionResponse(blogRevision(blog), true).RevisionSummary}
+	for _, revision := range revisions {
+		response = append(response, newRevisionResponse(revision, false).RevisionSummary)
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+func GetRevision(c *gin.Context) {
+	blog, ok := findEditableBlog(c)
+	if !ok {
+		return
+	}
+	number, err := revisionParam(blog, c.Param("rev"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
+	}
+	revision, err := findRevision(context.TODO(), blog, number)
+	if err != nil {
+		if errors.Is(err, ErrRevisionNotFound) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Revision not found"})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, newRevisionResponse(revision, number == currentRevision(blog)))
+}
+
+// DiffRevisions compares the content of revisions from and to, by line or
+// with mode=word by word. to defaults to the current version and from to
+// the one before to.
+func DiffRevisions(c *gin.Context) {
+	blog, ok := findEditableBlog(c)
+	if !ok {
+		return
+	}
+	mode := DiffMode(c.DefaultQuery("mode", string(DiffLines)))
+	if mode != DiffLines && mode != DiffWords {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "mode must be line or word"})
+		return
+	}
+	to, err := revisionParam(blog, c.DefaultQuery("to", "current"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
+	}
+	from := to - 1
+	if value := c.Query("from"); value != "" {
+		if from, err = revisionParam(blog, value); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+			return
+		}
+	}
+	revisions := make([]BlogRevision, 2)
+	for i, number := range []int{from, to} {
+		if revisions[i], err = findRevision(context.TODO(), blog, number); err != nil {
+			if errors.Is(err, ErrRevisionNotFound) {
+				c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Revision not found"})
+				return
+			}
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+			return
+		}
+	}
+	changes, err := computeDiff(revisions[0].Content, revisions[1].Content, mode)
+	if errors.Is(err, ErrDiffTooLarge) {
+		c.IndentedJSON(http.StatusUnprocessableEntity, gin.H{"Error": "The revisions are too large to compare"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"from":    newRevisionResponse(revisions[0], from == currentRevision(blog)).RevisionSummary,
+		"to":      newRevisionResponse(revisions[1], to == currentRevision(blog)).RevisionSummary,
+		"mode":    mode,
+		"changes": changes,
+	})
+}
+
+// RestoreRevision makes an earlier revision the current version again. The
+// version it replaces is kept like on any other edit.
+func RestoreRevision(c *gin.Context) {
+	principal := currentPrincipal(c)
+	blog, ok := findEditableBlog(c)
+	if !ok {
+		return
+	}
+	number, err := revisionParam(blog, c.Param("rev"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": err.Error()})
+		return
+	}
+	if number == currentRevision(blog) {
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": "That is already the current revision"})
+		return
+	}
+	revision, err := findRevision(context.TODO(), blog, number)
+	if err != nil {
+		if errors.Is(err, ErrRevisionNotFound) {
+			c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Revision not found"})
+			return
+		}
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	blog, err = editBlog(context.TODO(), blog, principal.UserID, revision.Title, revision.Summary, revision.Content)
+	if err != nil {
+		respondEditError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, newBlogResponse(blog))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A session is one login on one device. Its ID is the refresh token family
+// and the sid claim of the access tokens issued for it, so revoking the
+// session cuts off both.
+
+var ErrSessionRevoked = errors.New("session revoked or expired")
+
+// sessionSeenInterval limits how often last_seen_at is written for a
+// session that keeps making requests.
+const sessionSeenInterval = time.Minute
+
+// maxUserAgentLength bounds what is stored of the User-Agent header.
+const maxUserAgentLength = 512
+
+type SessionResponse struct {
+	ID         primitive.ObjectID `json:"id"`
+	UserAgent  string             `json:"user_agent"`
+	IP         string             `json:"ip"`
+	CreatedAt  time.Time          `json:"created_at"`
+	LastSeenAt time.Time          `json:"last_seen_at"`
+	RevokedAt  *time.Time         `json:"revoked_at,omitempty"`
+	// Current marks the session the request was made with.
+	Current bool `json:"current"`
+}
+
+// newSessionResponse maps session; currentID is the sid of the caller.
+func newSessionResponse(session Session, currentID string) SessionResponse {
+	return SessionResponse{
+		ID:         session.ID,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		CreatedAt:  session.CreatedAt,
+		LastSeenAt: session.LastSeenAt,
+		RevokedAt:  session.RevokedAt,
+		Current:    session.ID.Hex() == currentID,
+	}
+}
+
+// createSession records a new session of userID.
+func createSession(ctx context.Context, userID primitive.ObjectID, userAgent, ip string) (Session, error) {
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	now := time.Now()
+	session := Session{
+		ID:         primitive.NewObjectID(),
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(refreshTokenTTL),
+	}
+	if _, err := db.Collection("sessions").InsertOne(ctx, session); err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// checkSession fails with ErrSessionRevoked unless the session with the
+// hex id sid is still active, and notes that it was seen.
+func checkSession(ctx context.Context, sid string) error {
+	sessionID, err := primitive.ObjectIDFromHex(sid)
+	if err != nil {
+		return ErrSessionRevoked
+	}
+	var session Session
+	if err := db.Collection("sessions").FindOne(ctx, bson.M{"_id": sessionID}).Decode(&session); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrSessionRevoked
+		}
+		return err
+	}
+	now := time.Now()
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) {
+		return ErrSessionRevoked
+	}
+	if now.Sub(session.LastSeenAt) > sessionSeenInterval {
+		_, err = db.Collection("sessions").UpdateByID(ctx, sessionID, bson.M{"$set": bson.M{"last_seen_at": now}})
+	}
+	return err
+}
+
+// extendSession keeps a session alive as long as its refresh token is used.
+func extendSession(ctx context.Context, sessionID primitive.ObjectID) error {
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"last_seen_at": now, "expires_at": now.Add(refreshTokenTTL)}}
+	_, err := db.Collection("sessions").UpdateByID(ctx, sessionID, update)
+	return err
+}
+
+// revokeSessions revokes the sessions matching sessionFilter and the
+// refresh tokens matching tokenFilter, which must select the tokens of the
+// same sessions. It returns how many sessions were still active.
+func revokeSessions(ctx context.Context, sessionFilter, tokenFilter bson.M) (int64, error) {
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"revoked_at": now}}
+	sessionFilter["revoked_at"] = bson.M{"$exists": false}
+	result, err := db.Collection("sessions").UpdateMany(ctx, sessionFilter, update)
+	if err != nil {
+		return 0, err
+	}
+	tokenFilter["revoked_at"] = bson.M{"$exists": false}
+	if _, err := db.Collection("refreshtokens").UpdateMany(ctx, tokenFilter, update); err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// session handlers
+
+func ListSessions(c *gin.Context) {
+	principal := currentPrincipal(c)
+	filter := bson.M{"user_id": principal.UserID, "revoked_at": bson.M{"$exists": false}, "expires_at": bson.M{"$gt": time.Now()}}
+	opts := options.Find().SetSort(bson.M{"last_seen_at": -1})
+	cursor, err := db.Collection("sessions").Find(context.TODO(), filter, opts)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	sessions := []Session{}
+	if err = cursor.All(context.TODO(), &sessions); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	response := make([]SessionResponse, len(sessions))
+	for i, session := range sessions {
+		response[i] = newSessionResponse(session, principal.SessionID)
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// RevokeSession logs one of the caller's sessions out.
+func RevokeSession(c *gin.Context) {
+	principal := currentPrincipal(c)
+	sessionId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	count, err := revokeSessions(context.TODO(),
+		bson.M{"_id": sessionId, "user_id": principal.UserID},
+		bson.M{"family_id": sessionId, "user_id": principal.UserID})
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	if count == 0 {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Session not found"})
+		return
+	}
+	if sessionId.Hex() == principal.SessionID {
+		clearTokenCookies(c)
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Session revoked"})
+}
+
+// RevokeOtherSessions logs the caller out everywhere except the session the
+// request was made with.
+func RevokeOtherSessions(c *gin.Context) {
+	principal := currentPrincipal(c)
+	sessionFilter := bson.M{"user_id": principal.UserID}
+	tokenFilter := bson.M{"user_id": principal.UserID}
+	if currentID, err := primitive.ObjectIDFromHex(principal.SessionID); err == nil {
+		sessionFilter["_id"] = bson.M{"$ne": currentID}
+		tokenFilter["family_id"] = bson.M{"$ne": currentID}
+	}
+	count, err := revokeSessions(context.TODO(), sessionFilter, tokenFilter)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Other sessions revoked", "revoked": count})
+}
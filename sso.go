@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// oidcStateCookie ties the callback to the browser that started the login,
+// so nobody can slip their own sign-on response into someone else's session.
+const oidcStateCookie = "oidc_state"
+
+// stateCookies is cookieConfig relaxed to SameSite=Lax at most, because the
+// provider redirects back to the callback from another site.
+func stateCookies() CookieConfig {
+	cfg := cookieConfig
+	if cfg.SameSite == http.SameSiteStrictMode {
+		cfg.SameSite = http.SameSiteLaxMode
+	}
+	return cfg
+}
+
+var errNoFreeUsername = errors.New("no free username")
+
+// OIDCLogin starts a single sign-on by redirecting to the provider.
+func OIDCLogin(c *gin.Context) {
+	if oidcProvider == nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"Error": "Single sign-on is not configured"})
+		return
+	}
+	state, err := generateToken(32)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	nonce, err := generateToken(32)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	verifier, err := generateToken(32)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	now := time.Now()
+	record := OIDCState{
+		ID:           hashToken(state),
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(oidcStateTTL),
+	}
+	if _, err := db.Collection("oidcstates").InsertOne(context.TODO(), record); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	stateCookies().setCookie(c, oidcStateCookie, state, int(oidcStateTTL.Seconds()), "/users/oidc", true)
+	c.Redirect(http.StatusFound, oidcProvider.AuthCodeURL(state, nonce, verifier))
+}
+
+// OIDCCallback finishes a single sign-on: it redeems the code, verifies the
+// ID token and logs in the linked account, creating it on first use.
+func OIDCCallback(c *gin.Context) {
+	if oidcProvider == nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"Error": "Single sign-on is not configured"})
+		return
+	}
+	if reason := c.Query("error"); reason != "" {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Single sign-on was not completed: " + reason})
+		return
+	}
+	state := c.Query("state")
+	cookie, err := c.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie != state {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Invalid or expired sign-on request"})
+		return
+	}
+	stateCookies().setCookie(c, oidcStateCookie, "", -1, "/users/oidc", true)
+
+	var record OIDCState
+	filter := bson.M{"_id": hashToken(state), "expires_at": bson.M{"$gt": time.Now()}}
+	if err := db.Collection("oidcstates").FindOneAndDelete(context.TODO(), filter).Decode(&record); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"Error": "Invalid or expired sign-on request"})
+		return
+	}
+
+	rawIDToken, err := oidcProvider.Exchange(context.TODO(), c.Query("code"), record.CodeVerifier)
+	if err != nil {
+		log.Println("single sign-on:", err)
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Single sign-on failed"})
+		return
+	}
+	claims, err := oidcProvider.VerifyIDToken(context.TODO(), rawIDToken, record.Nonce)
+	if err != nil {
+		log.Println("single sign-on:", err)
+		c.IndentedJSON(http.StatusUnauthorized, gin.H{"Error": "Single sign-on failed"})
+		return
+	}
+	user, err := linkOIDCUser(context.TODO(), oidcProvider.Issuer(), claims)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+
+	if user.DeletedAt != nil {
+		c.IndentedJSON(http.StatusForbidden, gin.H{"Error": "This account has been deleted"})
+		return
+	}
+	if user.TOTPEnabled {
+		startMFAChallenge(c, user)
+		return
+	}
+	if err := startSession(c, user); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	recordAudit(c, AuditEvent{Action: AuditLogin, ActorID: user.ID, ActorName: user.Name, Details: map[string]string{"method": "oidc"}})
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Login successful"})
+}
+
+// linkOIDCUser returns the account linked to the sign-on identity. An
+// unlinked identity is attached to the local account with the same email
+// address if both sides verified it, and gets a new account otherwise.
+func linkOIDCUser(ctx context.Context, issuer string, claims *IDTokenClaims) (User, error) {
+	var user User
+	identity := bson.M{"oidc_issuer": issuer, "oidc_subject": claims.Subject}
+	err := db.Collection("users").FindOne(ctx, identity).Decode(&user)
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	email := normalizeEmail(claims.Email)
+	if email != "" && claims.EmailVerified {
+		filter := bson.M{"email": email, "email_verified": true, "oidc_subject": bson.M{"$exists": false}}
+		update := bson.M{"$set": identity}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+		err := db.Collection("users").FindOneAndUpdate(ctx, filter, update, opts).Decode(&user)
+		if err != mongo.ErrNoDocuments {
+			return user, err
+		}
+	}
+
+	name, err := availableUsername(ctx, usernameFromClaims(claims))
+	if err != nil {
+		return user, err
+	}
+	user = User{Name: name, Roles: []Role{defaultRole}, OIDCIssuer: issuer, OIDCSubject: claims.Subject}
+	if email != "" && claims.EmailVerified {
+		// an unverified local account may hold the address; it keeps it
+		if count, err := db.Collection("users").CountDocuments(ctx, bson.M{"email": email}); err == nil && count == 0 {
+			user.Email = email
+			user.EmailVerified = true
+		}
+	}
+	resp, err := db.Collection("users").InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent callback for the same identity got there first
+		err = db.Collection("users").FindOne(ctx, identity).Decode(&user)
+		return user, err
+	}
+	if err != nil {
+		return user, err
+	}
+	user.ID = resp.InsertedID.(primitive.ObjectID)
+	return user, nil
+}
+
+func usernameFromClaims(claims *IDTokenClaims) string {
+	if claims.PreferredUsername != "" {
+		return claims.PreferredUsername
+	}
+	if local, _, ok := strings.Cut(claims.Email, "@"); ok && local != "" {
+		return local
+	}
+	return "user"
+}
+
+// availableUsername returns base, or base with a random suffix if the name
+// is taken already.
+func availableUsername(ctx context.Context, base string) (string, error) {
+	name := base
+	for i := 0; i < 5; i++ {
+		count, err := db.Collection("users").CountDocuments(ctx, bson.M{"name": name})
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return name, nil
+		}
+		suffix, err := generateToken(3)
+		if err != nil {
+			return "", err
+		}
+		name = base + "-" + suffix
+	}
+	return "", errNoFreeUsername
+}
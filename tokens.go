@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrActionTokenInvalid  = errors.New("invalid or already used token")
+)
+
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposeResetPassword = "reset_password"
+)
+
+// issueRefreshToken stores a new refresh token for the given token family and
+// returns the raw token. Only its hash is persisted.
+func issueRefreshToken(ctx context.Context, userID, familyID primitive.ObjectID) (string, error) {
+	raw, err := generateToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := RefreshToken{
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(raw),
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}
+	if _, err := db.Collection("refreshtokens").InsertOne(ctx, token); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// rotateRefreshToken consumes raw and issues its successor in the same
+// family. A token that was already consumed or revoked is treated as stolen:
+// every token of its family is revoked and ErrRefreshTokenReused returned.
+func rotateRefreshToken(ctx context.Context, raw string) (RefreshToken, string, error) {
+	now := time.Now()
+	hash := hashToken(raw)
+
+	// claim the token atomically so two concurrent refreshes cannot both win
+	filter := bson.M{
+		"token_hash": hash,
+		"used_at":    bson.M{"$exists": false},
+		"revoked_at": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"used_at": now}}
+	var current RefreshToken
+	err := db.Collection("refreshtokens").FindOneAndUpdate(ctx, filter, update).Decode(&current)
+	if err == mongo.ErrNoDocuments {
+		if err := db.Collection("refreshtokens").FindOne(ctx, bson.M{"token_hash": hash}).Decode(&current); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return RefreshToken{}, "", ErrRefreshTokenInvalid
+			}
+			return RefreshToken{}, "", err
+		}
+		if err := revokeTokenFamily(ctx, current.FamilyID); err != nil {
+			return RefreshToken{}, "", err
+		}
+		return RefreshToken{}, "", ErrRefreshTokenReused
+	}
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	if now.After(current.ExpiresAt) {
+		return RefreshToken{}, "", ErrRefreshTokenExpired
+	}
+
+	next, err := issueRefreshToken(ctx, current.UserID, current.FamilyID)
+	if err != nil {
+		return RefreshToken{}, "", err
+	}
+	return current, next, nil
+}
+
+// revokeTokenFamily ends the session of a token family and revokes its
+// outstanding refresh tokens.
+func revokeTokenFamily(ctx context.Context, familyID primitive.ObjectID) error {
+	_, err := revokeSessions(ctx, bson.M{"_id": familyID}, bson.M{"family_id": familyID})
+	return err
+}
+
+// findRefreshToken looks up a refresh token by its raw value.
+func findRefreshToken(ctx context.Context, raw string) (RefreshToken, error) {
+	var token RefreshToken
+	err := db.Collection("refreshtokens").FindOne(ctx, bson.M{"token_hash": hashToken(raw)}).Decode(&token)
+	return token, err
+}
+
+// revokeUserSessions ends every session of the user.
+func revokeUserSessions(ctx context.Context, userID primitive.ObjectID) error {
+	_, err := revokeSessions(ctx, bson.M{"user_id": userID}, bson.M{"user_id": userID})
+	return err
+}
+
+// ActionClaims are carried by signed single-purpose tokens such as email
+// verification and password reset links. The token ID is recorded in the
+// actiontokens collection so that each token works only once.
+type ActionClaims struct {
+	Purpose string `json:"purpose"`
+	jwt.StandardClaims
+}
+
+// issueActionToken returns a signed token for purpose that expires after ttl.
+func issueActionToken(ctx context.Context, userID primitive.ObjectID, purpose string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	record := ActionToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Purpose:   purpose,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if _, err := db.Collection("actiontokens").InsertOne(ctx, record); err != nil {
+		return "", err
+	}
+	return signClaims(ActionClaims{
+		Purpose: purpose,
+		StandardClaims: jwt.StandardClaims{
+			Id:        record.ID.Hex(),
+			Subject:   userID.Hex(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: record.ExpiresAt.Unix(),
+		},
+	})
+}
+
+// consumeActionToken verifies raw for purpose and marks it used. It returns
+// ErrActionTokenInvalid for tokens that are forged, expired, meant for
+// another purpose or already used.
+func consumeActionToken(ctx context.Context, raw string, purpose string) (ActionToken, error) {
+	claims := &ActionClaims{}
+	if err := parseClaims(raw, claims); err != nil || claims.Purpose != purpose {
+		return ActionToken{}, ErrActionTokenInvalid
+	}
+	id, err := primitive.ObjectIDFromHex(claims.Id)
+	if err != nil {
+		return ActionToken{}, ErrActionTokenInvalid
+	}
+
+	filter := bson.M{"_id": id, "purpose": purpose, "used_at": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"used_at": time.Now()}}
+	var record ActionToken
+	err = db.Collection("actiontokens").FindOneAndUpdate(ctx, filter, update).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return ActionToken{}, ErrActionTokenInvalid
+	}
+	return record, err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// RFC 6238 appendix B, SHA1, truncated to six digits
+func TestTOTPReferenceVectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		assert.Equal(t, want, totpCode(secret, uint64(totpStep(time.Unix(unix, 0)))))
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+
+	step, ok := validateTOTP(secret, "050471", now, 0)
+	assert.Assert(t, ok)
+	assert.Equal(t, totpStep(now), step)
+
+	// one period of drift either way is tolerated
+	_, ok = validateTOTP(secret, "050471", now.Add(totpPeriod*time.Second), 0)
+	assert.Assert(t, ok)
+	_, ok = validateTOTP(secret, "050471", now.Add(2*totpPeriod*time.Second), 0)
+	assert.Assert(t, !ok)
+
+	// a step that was already used is refused
+	_, ok = validateTOTP(secret, "050471", now, step)
+	assert.Assert(t, !ok)
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totpProvisioningURI("blog-api", "jane doe", "JBSWY3DPEHPK3PXP")
+	assert.Assert(t, strings.HasPrefix(uri, "otpauth://totp/blog-api:jane%20doe?"))
+	assert.Assert(t, strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP"))
+	assert.Assert(t, strings.Contains(uri, "issuer=blog-api"))
+}
+
+func TestRecoveryCodesAreDistinct(t *testing.T) {
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	assert.NilError(t, err)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		assert.Equal(t, 11, len(code))
+		assert.Assert(t, !seen[code])
+		seen[code] = true
+	}
+}
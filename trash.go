@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deleting a user, blog or comment only sets its deleted_at; every read
+// path filters on notDeleted. Trashed items can be restored until the
+// purger removes them for good after trashRetention.
+
+// notDeleted matches documents that are not in the trash, as in
+// bson.M{"deleted_at": notDeleted}. It must not be modified.
+var notDeleted = bson.M{"$exists": false}
+
+var inTrash = bson.M{"$exists": true}
+
+// ErrParentDeleted is returned when restoring a comment whose blog is still
+// in the trash.
+var ErrParentDeleted = errors.New("the blog of this comment is in the trash")
+
+func newDeletionReport() DeletionReport {
+	return DeletionReport{Deleted: map[string]int64{}, Transferred: map[string]int64{}, Anonymized: map[string]int64{}}
+}
+
+func (r DeletionReport) add(other DeletionReport) {
+	for k, v := range other.Deleted {
+		r.Deleted[k] += v
+	}
+	for k, v := range other.Transferred {
+		r.Transferred[k] += v
+	}
+	for k, v := range other.Anonymized {
+		r.Anonymized[k] += v
+	}
+}
+
+// blogCommentsFilter matches the comments on blog, including those stored
+// before comments recorded their blog.
+func blogCommentsFilter(blog Blog) bson.M {
+	commentIDs := append([]primitive.ObjectID{}, blog.Comments...)
+	return bson.M{"$or": bson.A{
+		bson.M{"_id": bson.M{"$in": commentIDs}},
+		bson.M{"blog_id": blog.ID},
+	}}
+}
+
+// trashBlog moves a blog and its comments to the trash. The comments get
+// the blog's deleted_at, so that restoring the blog brings back exactly
+// those and not ones that were deleted on their own before.
+func trashBlog(ctx context.Context, blogID primitive.ObjectID, now time.Time) (int64, error) {
+	var blog Blog
+	filter := bson.M{"_id": blogID, "deleted_at": notDeleted}
+	update := bson.M{"$set": bson.M{"deleted_at": now}}
+	if err := db.Collection("blogs").FindOneAndUpdate(ctx, filter, update).Decode(&blog); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		return 0, err
+	}
+	comments := blogCommentsFilter(blog)
+	comments["deleted_at"] = notDeleted
+	if _, err := db.Collection("comments").UpdateMany(ctx, comments, update); err != nil {
+		return 1, err
+	}
+	return 1, nil
+}
+
+// trashComment takes a comment off its blog and moves it to the trash.
+func trashComment(ctx context.Context, blogID, commentID primitive.ObjectID, now time.Time) (int64, error) {
+	if _, err := db.Collection("blogs").UpdateByID(ctx, blogID, bson.M{"$pull": bson.M{"comments": commentID}}); err != nil {
+		return 0, err
+	}
+	filter := bson.M{"_id": commentID, "deleted_at": notDeleted}
+	// blog_id is recorded for comments stored before it existed, so that a
+	// restore knows where to put the comment back
+	update := bson.M{"$set": bson.M{"deleted_at": now, "blog_id": blogID}}
+	result, err := db.Collection("comments").UpdateOne(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func restoreBlog(ctx context.Context, blogID primitive.ObjectID) error {
+	var blog Blog
+	filter := bson.M{"_id": blogID, "deleted_at": inTrash}
+	update := bson.M{"$unset": bson.M{"deleted_at": ""}}
+	if err := db.Collection("blogs").FindOneAndUpdate(ctx, filter, update).Decode(&blog); err != nil {
+		return err
+	}
+	comments := blogCommentsFilter(blog)
+	comments["deleted_at"] = *blog.DeletedAt
+	_, err := db.Collection("comments").UpdateMany(ctx, comments, update)
+	return err
+}
+
+func restoreComment(ctx context.Context, commentID primitive.ObjectID) error {
+	var comment Comment
+	if err := db.Collection("comments").FindOne(ctx, bson.M{"_id": commentID, "deleted_at": inTrash}).Decode(&comment); err != nil {
+		return err
+	}
+	var blog Blog
+	if err := db.Collection("blogs").FindOne(ctx, bson.M{"_id": comment.BlogID}).Decode(&blog); err != nil {
+		return err
+	}
+	if blog.DeletedAt != nil {
+		return ErrParentDeleted
+	}
+	if _, err := db.Collection("comments").UpdateByID(ctx, commentID, bson.M{"$unset": bson.M{"deleted_at": ""}}); err != nil {
+		return err
+	}
+	_, err := db.Collection("blogs").UpdateByID(ctx, blog.ID, bson.M{"$addToSet": bson.M{"comments": commentID}})
+	return err
+}
+
+func restoreUser(ctx context.Context, userID primitive.ObjectID) error {
+	filter := bson.M{"_id": userID, "deleted_at": inTrash}
+	result, err := db.Collection("users").UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"deleted_at": ""}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// purgeBlog removes a blog for good, with its comments and blog record.
+func purgeBlog(ctx context.Context, blog Blog, report DeletionReport) error {
+	result, err := db.Collection("comments").DeleteMany(ctx, blogCommentsFilter(blog))
+	if err != nil {
+		return err
+	}
+	report.Deleted["comments"] += result.DeletedCount
+	if result, err = db.Collection("blogrecords").DeleteMany(ctx, bson.M{"blog_id": blog.ID}); err != nil {
+		return err
+	}
+	report.Deleted["blogrecords"] += result.DeletedCount
+	if result, err = db.Collection("blogrevisions").DeleteMany(ctx, bson.M{"blog_id": blog.ID}); err != nil {
+		return err
+	}
+	report.Deleted["blogrevisions"] += result.DeletedCount
+	if result, err = db.Collection("blogs").DeleteOne(ctx, bson.M{"_id": blog.ID}); err != nil {
+		return err
+	}
+	report.Deleted["blogs"] += result.DeletedCount
+	return nil
+}
+
+// purgeTrash permanently removes everything that went to the trash at or
+// before cutoff. Users are removed as userDeletionPolicy says. An item that
+// cannot be removed is logged and skipped, so that it does not hold up the
+// rest; the errors are returned together.
+func purgeTrash(ctx context.Context, cutoff time.Time) (DeletionReport, error) {
+	report := newDeletionReport()
+	expired := bson.M{"deleted_at": bson.M{"$lte": cutoff}}
+
+	cursor, err := db.Collection("blogs").Find(ctx, expired)
+	if err != nil {
+		return report, err
+	}
+	blogs := []Blog{}
+	if err = cursor.All(ctx, &blogs); err != nil {
+		return report, err
+	}
+	var errs []error
+	for _, blog := range blogs {
+		if err := purgeBlog(ctx, blog, report); err != nil {
+			log.Printf("purging blog %s failed: %v", blog.ID.Hex(), err)
+			errs = append(errs, err)
+		}
+	}
+
+	result, err := db.Collection("comments").DeleteMany(ctx, expired)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		report.Deleted["comments"] += result.DeletedCount
+	}
+
+	cursor, err = db.Collection("users").Find(ctx, expired)
+	if err != nil {
+		return report, errors.Join(append(errs, err)...)
+	}
+	users := []User{}
+	if err = cursor.All(ctx, &users); err != nil {
+		return report, errors.Join(append(errs, err)...)
+	}
+	for _, user := range users {
+		userReport, err := deleteUser(ctx, user.ID, userDeletionPolicy)
+		report.add(userReport)
+		if err != nil {
+			log.Printf("purging user %s failed: %v", user.ID.Hex(), err)
+			errs = append(errs, err)
+		}
+	}
+	return report, errors.Join(errs...)
+}
+
+// runTrashPurger purges expired trash every interval.
+func runTrashPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := purgeTrash(context.Background(), time.Now().Add(-trashRetention))
+		if err != nil {
+			log.Println("purging trash failed:", err)
+		}
+		if report.Deleted["blogs"]+report.Deleted["comments"]+report.Deleted["users"] > 0 {
+			log.Printf("purged trash: %v", report.Deleted)
+		}
+	}
+}
+
+// trash handlers
+
+func ListTrashedBlogs(c *gin.Context) {
+	principal := currentPrincipal(c)
+	filter := bson.M{"deleted_at": inTrash}
+	if principal.Reach(PermBlogsWrite) != ReachAny {
+		blogIDs, err := ownedBlogIDs(context.TODO(), principal.UserID)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+			return
+		}
+		filter["_id"] = bson.M{"$in": blogIDs}
+	}
+	opts := options.Find().SetSort(bson.M{"deleted_at": -1})
+	cursor, err := db.Collection("blogs").Find(context.TODO(), filter, opts)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	blogs := []Blog{}
+	if err = cursor.All(context.TODO(), &blogs); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	response := make([]BlogResponse, len(blogs))
+	for i, blog := range blogs {
+		response[i] = newBlogResponse(blog)
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// ListTrashedComments lists the caller's own trashed comments and those
+// trashed on their blogs, or all of them for moderators.
+func ListTrashedComments(c *gin.Context) {
+	principal := currentPrincipal(c)
+	filter := bson.M{"deleted_at": inTrash}
+	if principal.Reach(PermCommentsWrite) != ReachAny {
+		blogIDs, err := ownedBlogIDs(context.TODO(), principal.UserID)
+		if err != nil {
+			c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+			return
+		}
+		filter["$or"] = bson.A{
+			bson.M{"author_id": principal.UserID},
+			bson.M{"blog_id": bson.M{"$in": blogIDs}},
+		}
+	}
+	opts := options.Find().SetSort(bson.M{"deleted_at": -1})
+	cursor, err := db.Collection("comments").Find(context.TODO(), filter, opts)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	comments := []Comment{}
+	if err = cursor.All(context.TODO(), &comments); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	response := make([]CommentResponse, len(comments))
+	for i, comment := range comments {
+		response[i] = newCommentResponse(comment)
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+func ListTrashedUsers(c *gin.Context) {
+	opts := options.Find().SetSort(bson.M{"deleted_at": -1})
+	cursor, err := db.Collection("users").Find(context.TODO(), bson.M{"deleted_at": inTrash}, opts)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	users := []User{}
+	if err = cursor.All(context.TODO(), &users); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+		return
+	}
+	response := make([]interface{}, len(users))
+	for i, user := range users {
+		response[i] = newUserResponse(user, VisibilityAdmin)
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+// respondTrashError answers for the errors restore and purge share.
+func respondTrashError(c *gin.Context, err error) {
+	switch {
+	case err == mongo.ErrNoDocuments:
+		c.IndentedJSON(http.StatusNotFound, gin.H{"message": "Not found in trash"})
+	case err == ErrParentDeleted:
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": "Restore the blog of this comment first"})
+	case errors.Is(err, ErrTransferTarget):
+		c.IndentedJSON(http.StatusConflict, gin.H{"Error": err.Error()})
+	default:
+		log.Println("trash:", err)
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"Error": "Something bad happened, please try again"})
+	}
+}
+
+func RestoreBlog(c *gin.Context) {
+	blogId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	if err := restoreBlog(context.TODO(), blogId); err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Blog restored"})
+}
+
+func RestoreComment(c *gin.Context) {
+	commentId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	if err := restoreComment(context.TODO(), commentId); err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "Comment restored"})
+}
+
+func RestoreUser(c *gin.Context) {
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	if err := restoreUser(context.TODO(), userId); err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	recordAudit(c, AuditEvent{Action: AuditUserRestored, TargetID: userId})
+	c.IndentedJSON(http.StatusOK, gin.H{"Message": "User restored"})
+}
+
+// respondPurged replies like the delete handlers do, with the report of
+// what went along with the purged item.
+func respondPurged(c *gin.Context, collection string, report DeletionReport) {
+	c.IndentedJSON(http.StatusOK, gin.H{
+		"DeletedCount": report.Deleted[collection],
+		"deleted":      report.Deleted,
+		"transferred":  report.Transferred,
+		"anonymized":   report.Anonymized,
+	})
+}
+
+// PurgeBlog removes a trashed blog right away instead of waiting for the
+// purger.
+func PurgeBlog(c *gin.Context) {
+	blogId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	var blog Blog
+	if err := db.Collection("blogs").FindOne(context.TODO(), bson.M{"_id": blogId, "deleted_at": inTrash}).Decode(&blog); err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	report := newDeletionReport()
+	if err := purgeBlog(context.TODO(), blog, report); err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	respondPurged(c, "blogs", report)
+}
+
+func PurgeComment(c *gin.Context) {
+	commentId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	result, err := db.Collection("comments").DeleteOne(context.TODO(), bson.M{"_id": commentId, "deleted_at": inTrash})
+	if err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	if result.DeletedCount == 0 {
+		respondTrashError(c, mongo.ErrNoDocuments)
+		return
+	}
+	report := newDeletionReport()
+	report.Deleted["comments"] = result.DeletedCount
+	respondPurged(c, "comments", report)
+}
+
+// PurgeUser removes a trashed user right away, as userDeletionPolicy says.
+func PurgeUser(c *gin.Context) {
+	userId, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, gin.H{"message": "Invalid id"})
+		return
+	}
+	count, err := db.Collection("users").CountDocuments(context.TODO(), bson.M{"_id": userId, "deleted_at": inTrash})
+	if err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	if count == 0 {
+		respondTrashError(c, mongo.ErrNoDocuments)
+		return
+	}
+	report, err := deleteUser(context.TODO(), userId, userDeletionPolicy)
+	if err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	recordAudit(c, AuditEvent{Action: AuditUserPurged, TargetID: userId})
+	respondPurged(c, "users", report)
+}